@@ -0,0 +1,440 @@
+package chatbot
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+/* Account linking binds a PSID to an Authentik account:
+the bot sends a one-time link to LinkPath, which redirects to the issuer's login page.
+The issuer sends the user back to LinkCallbackPath with a code, which is exchanged for an ID token.
+Whoever logs in is not necessarily the Messenger user the link was sent to (it may have been forwarded),
+so the username and groups in the token are only stored as the user's auth.Identity once the
+Messenger user confirms them in chat. The callback page names the Messenger user to the one who logged in. */
+
+const (
+	LinkPath         = "/chatbot/link"
+	LinkCallbackPath = "/chatbot/link/callback"
+
+	identitiesBucket   = "identities"
+	linkSessionsBucket = "link_sessions"
+
+	// How long a link sent in chat can be used, and how long the user has to confirm after logging in
+	linkSessionTTL = 10 * time.Minute
+
+	// Payloads of the buttons confirming a login, followed by the session token
+	linkConfirmPayloadPrefix = "link-confirm:"
+	linkCancelPayloadPrefix  = "link-cancel:"
+)
+
+// IdentityStore keeps the Authentik accounts users have linked
+type IdentityStore struct {
+	store storage.Store
+}
+
+func NewIdentityStore(s storage.Store) *IdentityStore {
+	return &IdentityStore{store: s}
+}
+
+func (i *IdentityStore) Save(identity auth.Identity) error {
+	if err := i.store.Put(identitiesBucket, identity.UserID, identity); err != nil {
+		return errors.Wrapf(err, "failed to store identity of %s", identity.UserID)
+	}
+	return nil
+}
+
+// Get returns the identity linked to the user with the given PSID
+func (i *IdentityStore) Get(userID string) (auth.Identity, bool, error) {
+	var identity auth.Identity
+	found, err := i.store.Get(identitiesBucket, userID, &identity)
+	if err != nil {
+		return auth.Identity{}, false, errors.Wrapf(err, "failed to get identity of %s", userID)
+	}
+	return identity, found, nil
+}
+
+func (i *IdentityStore) Delete(userID string) error {
+	if err := i.store.Delete(identitiesBucket, userID); err != nil {
+		return errors.Wrapf(err, "failed to delete identity of %s", userID)
+	}
+	return nil
+}
+
+func (i *IdentityStore) All() ([]auth.Identity, error) {
+	ids, err := i.store.Keys(identitiesBucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list identities")
+	}
+	res := []auth.Identity{}
+	for _, id := range ids {
+		identity, found, err := i.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			res = append(res, identity)
+		}
+	}
+	return res, nil
+}
+
+// linkSession is created for every link sent in chat. Its token is also the OIDC state
+type linkSession struct {
+	UserID    string    `json:"userID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Set when the user opens the link, cleared once the login completes
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	// Set when the login completed, waiting for the Messenger user to confirm it
+	Identity *auth.Identity `json:"identity,omitempty"`
+}
+
+func (s linkSession) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// EnableAccountLinking lets users link their Authentik account. publicURL is where this server is reachable from browsers.
+// Links expire after maxAge so that group changes at the issuer are picked up
+func (c *ChatbotHandler) EnableAccountLinking(publicURL string, config oidc.Config, maxAge time.Duration) error {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	if publicURL == "" {
+		return errors.Errorf("public URL is required for account linking")
+	}
+	if maxAge <= 0 {
+		return errors.Errorf("linked accounts must expire, got max age %s", maxAge)
+	}
+	config.RedirectURL = publicURL + LinkCallbackPath
+	provider, err := oidc.NewProvider(config)
+	if err != nil {
+		return errors.Wrapf(err, "invalid OIDC config")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.oidcProvider = provider
+	c.publicURL = publicURL
+	c.linkMaxAge = maxAge
+	return nil
+}
+
+func (c *ChatbotHandler) accountLinking() (*oidc.Provider, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.oidcProvider, c.publicURL
+}
+
+// showLinkedAccount shows the user's linked account, if any, and a new one-time link when entering the link account state
+func showLinkedAccount(c *ChatbotHandler, user auth.User) (string, error) {
+	provider, publicURL := c.accountLinking()
+	if provider == nil {
+		return "", fmt.Errorf("Account linking is not set up")
+	}
+	status := "Your Messenger account is not linked yet."
+	identity, found, err := c.Identities.Get(user.ID)
+	if err != nil {
+		glog.Errorf("failed to get identity of %s: %s", user.ID, err.Error())
+		return "", fmt.Errorf("Failed to read your linked account")
+	}
+	if found && identity.Active(time.Now()) {
+		status = fmt.Sprintf("You are linked to '%s'%s until %s. Send 'unlink' to remove the link.", identity.Username, formatIdentityGroups(identity), identity.ExpiresAt.Format(time.RFC1123))
+	}
+
+	token, err := oidc.RandomString()
+	if err != nil {
+		glog.Errorf("failed to create link session: %s", err.Error())
+		return "", fmt.Errorf("Failed to create a login link, please try again")
+	}
+	if err := c.Identities.store.Put(linkSessionsBucket, token, linkSession{UserID: user.ID, ExpiresAt: time.Now().Add(linkSessionTTL)}); err != nil {
+		glog.Errorf("failed to store link session: %s", err.Error())
+		return "", fmt.Errorf("Failed to create a login link, please try again")
+	}
+	link := fmt.Sprintf("%s%s?token=%s", publicURL, LinkPath, token)
+	return fmt.Sprintf("%s\n\nLog in with your Authentik account within %s to link it: %s\nDo not share this link.", status, linkSessionTTL, link), nil
+}
+
+func formatIdentityGroups(identity auth.Identity) string {
+	if len(identity.Groups) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (groups: %s)", strings.Join(identity.Groups, ", "))
+}
+
+// unlinkAccount removes the user's linked account when they send "unlink" in the link account state
+func unlinkAccount(c *ChatbotHandler, user auth.User, input string) (string, error) {
+	if !strings.EqualFold(strings.TrimSpace(input), "unlink") {
+		return "", fmt.Errorf("Open the link above to link your account, or send 'unlink' to remove the current link")
+	}
+	identity, found, err := c.Identities.Get(user.ID)
+	if err != nil {
+		glog.Errorf("failed to get identity of %s: %s", user.ID, err.Error())
+		return "", fmt.Errorf("Failed to read your linked account")
+	}
+	if !found {
+		return "", fmt.Errorf("Your account is not linked")
+	}
+	if err := c.Identities.Delete(user.ID); err != nil {
+		glog.Errorf("failed to unlink %s: %s", user.ID, err.Error())
+		return "", fmt.Errorf("Failed to unlink your account, please try again")
+	}
+	glog.Infof("user %s unlinked Authentik account '%s'", user.ID, identity.Username)
+	return fmt.Sprintf("Unlinked '%s'.", identity.Username), nil
+}
+
+// LinkHandleFunc redirects the browser of a user who opened a link sent in chat to the issuer's login page.
+// With cancel set, it discards a login waiting for confirmation instead
+func (c *ChatbotHandler) LinkHandleFunc(w http.ResponseWriter, r *http.Request) {
+	provider, _ := c.accountLinking()
+	if provider == nil {
+		fbapi.ResponseWrite(w, http.StatusNotFound, "account linking is not set up")
+		return
+	}
+	token := r.URL.Query().Get("token")
+	session, ok := c.linkSession(token)
+	if ok && session.Identity != nil && r.URL.Query().Get("cancel") != "" {
+		c.deleteLinkSession(token)
+		glog.Warningf("login of '%s' for %s was cancelled from the browser", session.Identity.Username, session.UserID)
+		fbapi.ResponseWrite(w, http.StatusOK, "Cancelled, your account will not be linked.")
+		return
+	}
+	if !ok || session.Identity != nil {
+		fbapi.ResponseWrite(w, http.StatusBadRequest, "This link is invalid or has expired. Please ask the bot for a new one.")
+		return
+	}
+	nonce, errNonce := oidc.RandomString()
+	verifier, errVerifier := oidc.RandomString()
+	if errNonce != nil || errVerifier != nil {
+		fbapi.ResponseWrite(w, http.StatusInternalServerError, "failed to start login")
+		return
+	}
+	// opening the link again restarts the login
+	session.Nonce = nonce
+	session.CodeVerifier = verifier
+	if err := c.Identities.store.Put(linkSessionsBucket, token, session); err != nil {
+		glog.Errorf("failed to store link session: %s", err.Error())
+		fbapi.ResponseWrite(w, http.StatusInternalServerError, "failed to start login")
+		return
+	}
+	loginURL, err := provider.AuthCodeURL(token, nonce, verifier)
+	if err != nil {
+		glog.Errorf("failed to build login URL: %s", err.Error())
+		fbapi.ResponseWrite(w, http.StatusBadGateway, "the identity provider is unavailable, please try again later")
+		return
+	}
+	http.Redirect(w, r, loginURL, http.StatusFound)
+}
+
+// LinkCallbackHandleFunc completes the login and asks the Messenger user the link was sent to to confirm it.
+// The state can only be used once
+func (c *ChatbotHandler) LinkCallbackHandleFunc(w http.ResponseWriter, r *http.Request) {
+	provider, _ := c.accountLinking()
+	if provider == nil {
+		fbapi.ResponseWrite(w, http.StatusNotFound, "account linking is not set up")
+		return
+	}
+	q := r.URL.Query()
+	token := q.Get("state")
+	session, ok := c.linkSession(token)
+	if !ok || session.Nonce == "" || session.Identity != nil {
+		fbapi.ResponseWrite(w, http.StatusBadRequest, "This link is invalid or has expired. Please ask the bot for a new one.")
+		return
+	}
+	nonce, verifier := session.Nonce, session.CodeVerifier
+	session.Nonce, session.CodeVerifier = "", ""
+	if err := c.Identities.store.Put(linkSessionsBucket, token, session); err != nil {
+		glog.Errorf("failed to store link session: %s", err.Error())
+		fbapi.ResponseWrite(w, http.StatusInternalServerError, "failed to complete login")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		glog.Warningf("login of %s failed at the issuer: %s %s", session.UserID, e, q.Get("error_description"))
+		c.deleteLinkSession(token)
+		fbapi.ResponseWrite(w, http.StatusForbidden, fmt.Sprintf("Login failed: %s. Please ask the bot for a new link.", e))
+		return
+	}
+	claims, err := provider.Exchange(q.Get("code"), verifier, nonce)
+	if err != nil {
+		glog.Errorf("failed to complete login of %s: %s", session.UserID, err.Error())
+		c.deleteLinkSession(token)
+		fbapi.ResponseWrite(w, http.StatusForbidden, "Login failed. Please ask the bot for a new link.")
+		return
+	}
+
+	identity := auth.Identity{
+		UserID:   session.UserID,
+		Username: claims.Username,
+		Subject:  claims.Subject,
+		Groups:   claims.Groups,
+	}
+	if msg, err := c.checkNotLinkedElsewhere(identity); err != nil {
+		c.deleteLinkSession(token)
+		fbapi.ResponseWrite(w, http.StatusConflict, msg)
+		return
+	}
+	session.Identity = &identity
+	session.ExpiresAt = time.Now().Add(linkSessionTTL)
+	if err := c.Identities.store.Put(linkSessionsBucket, token, session); err != nil {
+		glog.Errorf("failed to store link session: %s", err.Error())
+		fbapi.ResponseWrite(w, http.StatusInternalServerError, "failed to complete login")
+		return
+	}
+	if err := c.askToConfirmLink(token, identity); err != nil {
+		glog.Errorf("failed to ask %s to confirm the link: %s", session.UserID, err.Error())
+		c.deleteLinkSession(token)
+		fbapi.ResponseWrite(w, http.StatusBadGateway, "Failed to reach you on Messenger. Please ask the bot for a new link.")
+		return
+	}
+	_, publicURL := c.accountLinking()
+	messengerUser := c.RBAC().WhoAmI(session.UserID)
+	fbapi.ResponseWrite(w, http.StatusOK, fmt.Sprintf("You logged in as '%s'. This account will be linked to Messenger user '%s'(ID: %s) once they confirm it in the chat within %s.\n\n"+
+		"If you did not open this link from your own Messenger chat with the bot, someone may be trying to get your permissions. "+
+		"Cancel it at %s%s?token=%s&cancel=1 and tell an admin.", identity.Username, messengerUser.Name, messengerUser.ID, linkSessionTTL, publicURL, LinkPath, token))
+}
+
+// askToConfirmLink sends the Messenger user of a session Confirm and Cancel buttons for identity
+func (c *ChatbotHandler) askToConfirmLink(token string, identity auth.Identity) error {
+	msg := fmt.Sprintf("Link your Messenger account to Authentik user '%s'%s? Only confirm if you just logged in yourself.", identity.Username, formatIdentityGroups(identity))
+	if err := fbapi.SendRawMessage(identity.UserID, msg); err != nil {
+		return err
+	}
+	buttons := eventsToPostbackButtons([]statemachine.Event{
+		{Name: linkConfirmPayloadPrefix + token, Message: "Confirm"},
+		{Name: linkCancelPayloadPrefix + token, Message: "Cancel"},
+	})
+	elements := getPostbackElements("Link Authentik account?", "Tap to answer", buttons)
+	return fbapi.SendPostBackMessage(identity.UserID, getPostbackPayload(identity.UserID, elements))
+}
+
+func isLinkDecision(payload string) bool {
+	return strings.HasPrefix(payload, linkConfirmPayloadPrefix) || strings.HasPrefix(payload, linkCancelPayloadPrefix)
+}
+
+// processLinkDecision stores or discards the identity of a completed login once the Messenger user it was for answers
+func (c *ChatbotHandler) processLinkDecision(user auth.User, payload string, moveFSMResult MoveFSMResult) error {
+	confirmed := strings.HasPrefix(payload, linkConfirmPayloadPrefix)
+	token := strings.TrimPrefix(strings.TrimPrefix(payload, linkConfirmPayloadPrefix), linkCancelPayloadPrefix)
+	session, ok := c.linkSession(token)
+	switch {
+	case !ok || session.Identity == nil || session.UserID != user.ID:
+		moveFSMResult.AdditionalMsg = "This login has expired. Open 'Link account' to get a new link."
+	case !confirmed:
+		c.deleteLinkSession(token)
+		glog.Infof("user %s cancelled linking Authentik account '%s'", user.ID, session.Identity.Username)
+		moveFSMResult.AdditionalMsg = "Cancelled, your account was not linked."
+	default:
+		c.deleteLinkSession(token)
+		identity := *session.Identity
+		now := time.Now()
+		identity.LinkedAt = now
+		c.mu.Lock()
+		identity.ExpiresAt = now.Add(c.linkMaxAge)
+		c.mu.Unlock()
+		if msg, err := c.linkIdentity(identity); err != nil {
+			moveFSMResult.AdditionalMsg = msg
+		} else {
+			moveFSMResult.AdditionalMsg = fmt.Sprintf("Your Messenger account is now linked to '%s'%s until %s.", identity.Username, formatIdentityGroups(identity), identity.ExpiresAt.Format(time.RFC1123))
+		}
+	}
+	return respondToUser(user.ID, moveFSMResult)
+}
+
+// checkNotLinkedElsewhere returns an error if the account of identity is linked to another PSID.
+// On error the returned message is safe to show to the user
+func (c *ChatbotHandler) checkNotLinkedElsewhere(identity auth.Identity) (string, error) {
+	identities, err := c.Identities.All()
+	if err != nil {
+		glog.Errorf("failed to list identities: %s", err.Error())
+		return "Failed to link your account, please try again.", err
+	}
+	now := time.Now()
+	for _, other := range identities {
+		if other.Subject == identity.Subject && other.UserID != identity.UserID && other.Active(now) {
+			glog.Warningf("user %s tried to link '%s' which is already linked to %s", identity.UserID, identity.Username, other.UserID)
+			return fmt.Sprintf("'%s' is already linked to another Messenger account. Unlink it there first.", identity.Username), errors.Errorf("account already linked")
+		}
+	}
+	return "", nil
+}
+
+// linkIdentity stores identity unless its account is already linked to another PSID.
+// On error the returned message is safe to show to the user
+func (c *ChatbotHandler) linkIdentity(identity auth.Identity) (string, error) {
+	if msg, err := c.checkNotLinkedElsewhere(identity); err != nil {
+		return msg, err
+	}
+	if err := c.Identities.Save(identity); err != nil {
+		glog.Errorf("failed to link %s: %s", identity.UserID, err.Error())
+		return "Failed to link your account, please try again.", err
+	}
+	glog.Infof("user %s linked Authentik account '%s' with groups %v until %s", identity.UserID, identity.Username, identity.Groups, identity.ExpiresAt)
+	return "", nil
+}
+
+func (c *ChatbotHandler) deleteLinkSession(token string) {
+	if err := c.Identities.store.Delete(linkSessionsBucket, token); err != nil {
+		glog.Errorf("failed to delete link session: %s", err.Error())
+	}
+}
+
+// linkSession returns the unexpired session with the given token
+func (c *ChatbotHandler) linkSession(token string) (linkSession, bool) {
+	if token == "" {
+		return linkSession{}, false
+	}
+	var session linkSession
+	found, err := c.Identities.store.Get(linkSessionsBucket, token, &session)
+	if err != nil {
+		glog.Errorf("failed to get link session: %s", err.Error())
+		return linkSession{}, false
+	}
+	return session, found && !session.expired(time.Now())
+}
+
+// expireLinkSessions deletes the sessions of links which can no longer be used
+func (c *ChatbotHandler) expireLinkSessions(now time.Time) {
+	tokens, err := c.Identities.store.Keys(linkSessionsBucket)
+	if err != nil {
+		glog.Errorf("failed to list link sessions: %s", err.Error())
+		return
+	}
+	for _, token := range tokens {
+		var session linkSession
+		found, err := c.Identities.store.Get(linkSessionsBucket, token, &session)
+		if err != nil || !found || !session.expired(now) {
+			continue
+		}
+		c.deleteLinkSession(token)
+	}
+}
+
+// expireIdentities deletes the links which have expired and lets their users know
+func (c *ChatbotHandler) expireIdentities(now time.Time) {
+	identities, err := c.Identities.All()
+	if err != nil {
+		glog.Errorf("failed to list identities: %s", err.Error())
+		return
+	}
+	for _, identity := range identities {
+		if identity.Active(now) {
+			continue
+		}
+		if err := c.Identities.Delete(identity.UserID); err != nil {
+			glog.Errorf("failed to delete expired identity of %s: %s", identity.UserID, err.Error())
+			continue
+		}
+		glog.Infof("link of %s to Authentik account '%s' expired", identity.UserID, identity.Username)
+		msg := fmt.Sprintf("Your link to Authentik account '%s' has expired. Link it again from 'Link account' to keep the permissions of its groups.", identity.Username)
+		if err := fbapi.SendRawMessage(identity.UserID, msg); err != nil {
+			glog.Warningf("failed to notify %s about expired link: %s", identity.UserID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package chatbot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc"
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc/oidctest"
+)
+
+const testPublicURL = "https://bot.example.com"
+
+var linkTokenRegexp = regexp.MustCompile(`token=(\S+)`)
+
+func newTestIssuer(t *testing.T, c *ChatbotHandler) *oidctest.Issuer {
+	issuer, err := oidctest.NewIssuer("chatbot", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	issuer.SetUser(map[string]interface{}{"sub": "authentik-1", "preferred_username": "viktor", "groups": []string{"viktor"}})
+	if err := c.EnableAccountLinking(testPublicURL, oidc.Config{IssuerURL: issuer.URL, ClientID: issuer.ClientID, ClientSecret: issuer.ClientSecret}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+// newLink returns the token of a new link sent to userID in chat
+func newLink(t *testing.T, c *ChatbotHandler, userID string) string {
+	msg, err := showLinkedAccount(c, c.RBAC().WhoAmI(userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := linkTokenRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("no link in '%s'", msg)
+	}
+	return m[1]
+}
+
+// login opens the link with token and logs in at the issuer. It returns the URL the issuer sends the browser back to
+func login(t *testing.T, c *ChatbotHandler, token string) string {
+	w := httptest.NewRecorder()
+	c.LinkHandleFunc(w, httptest.NewRequest(http.MethodGet, LinkPath+"?token="+url.QueryEscape(token), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("opening the link: got %d %s", w.Code, w.Body.String())
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, testPublicURL+LinkCallbackPath) {
+		t.Fatalf("issuer redirected to '%s'", callback)
+	}
+	return callback
+}
+
+func callback(c *ChatbotHandler, callbackURL string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.LinkCallbackHandleFunc(w, httptest.NewRequest(http.MethodGet, callbackURL, nil))
+	return w
+}
+
+func linkedIdentity(t *testing.T, c *ChatbotHandler, userID string) (auth.Identity, bool) {
+	identity, found, err := c.Identities.Get(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity, found
+}
+
+func isAdmin(c *ChatbotHandler, userID string) bool {
+	rbac := c.RBAC()
+	return rbac.UserHasRole(rbac.WhoAmI(userID), auth.Role{Name: "admin"})
+}
+
+func TestLinkAccountAfterConfirmation(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	newTestIssuer(t, c)
+	const user = "psid-linking"
+
+	token := newLink(t, c, user)
+	callbackURL := login(t, c, token)
+	w := callback(c, callbackURL)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), user) {
+		t.Fatalf("callback: got %d %s, want the Messenger user named", w.Code, w.Body.String())
+	}
+	if _, found := linkedIdentity(t, c, user); found {
+		t.Fatal("identity was linked before the Messenger user confirmed it")
+	}
+	sent := sendAPI.to(user)
+	if len(sent) != 2 || !strings.Contains(sent[0].Text, "'viktor' (groups: viktor)") || !sent[1].Buttons {
+		t.Fatalf("got messages %+v, want a confirmation with buttons", sent)
+	}
+
+	// the state can only be used once
+	if w := callback(c, callbackURL); w.Code != http.StatusBadRequest {
+		t.Fatalf("reused state: got %d %s", w.Code, w.Body.String())
+	}
+	// only the Messenger user the link was sent to can confirm
+	postMessage(t, c, "psid-other", linkConfirmPayloadPrefix+token)
+	if _, found := linkedIdentity(t, c, "psid-other"); found {
+		t.Fatal("another user confirmed the link")
+	}
+
+	postMessage(t, c, user, linkConfirmPayloadPrefix+token)
+	identity, found := linkedIdentity(t, c, user)
+	if !found || identity.Username != "viktor" || identity.Subject != "authentik-1" {
+		t.Fatalf("got identity %+v after confirming", identity)
+	}
+	if d := time.Until(identity.ExpiresAt); d <= 0 || d > time.Hour {
+		t.Fatalf("identity expires in %s, want at most the max age", d)
+	}
+	if !isAdmin(c, user) {
+		t.Fatal("linked group did not give its roles")
+	}
+	// the confirmation can only be used once
+	if _, ok := c.linkSession(token); ok {
+		t.Fatal("link session was kept after confirming")
+	}
+}
+
+func TestLinkAccountCancelled(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	newTestIssuer(t, c)
+	const user = "psid-cancelling"
+
+	token := newLink(t, c, user)
+	if w := callback(c, login(t, c, token)); w.Code != http.StatusOK {
+		t.Fatalf("callback: got %d %s", w.Code, w.Body.String())
+	}
+	postMessage(t, c, user, linkCancelPayloadPrefix+token)
+	postMessage(t, c, user, linkConfirmPayloadPrefix+token)
+	if _, found := linkedIdentity(t, c, user); found {
+		t.Fatal("identity was linked after cancelling")
+	}
+
+	// cancelling from the browser
+	token = newLink(t, c, user)
+	if w := callback(c, login(t, c, token)); w.Code != http.StatusOK {
+		t.Fatalf("callback: got %d %s", w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	c.LinkHandleFunc(w, httptest.NewRequest(http.MethodGet, LinkPath+"?cancel=1&token="+url.QueryEscape(token), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d %s", w.Code, w.Body.String())
+	}
+	postMessage(t, c, user, linkConfirmPayloadPrefix+token)
+	if _, found := linkedIdentity(t, c, user); found {
+		t.Fatal("identity was linked after cancelling from the browser")
+	}
+}
+
+func TestLinkCallbackRejects(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	issuer := newTestIssuer(t, c)
+	const user = "psid-rejected"
+
+	t.Run("expired state", func(t *testing.T) {
+		token := newLink(t, c, user)
+		callbackURL := login(t, c, token)
+		session, _ := c.linkSession(token)
+		session.ExpiresAt = time.Now().Add(-time.Second)
+		if err := c.Identities.store.Put(linkSessionsBucket, token, session); err != nil {
+			t.Fatal(err)
+		}
+		if w := callback(c, callbackURL); w.Code != http.StatusBadRequest {
+			t.Fatalf("got %d %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("unknown state", func(t *testing.T) {
+		callbackURL := login(t, c, newLink(t, c, user))
+		if w := callback(c, strings.Replace(callbackURL, "state=", "state=x", 1)); w.Code != http.StatusBadRequest {
+			t.Fatalf("got %d %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("expired ID token", func(t *testing.T) {
+		issuer.SetTokenLifetime(-time.Hour)
+		defer issuer.SetTokenLifetime(5 * time.Minute)
+		token := newLink(t, c, user)
+		if w := callback(c, login(t, c, token)); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d %s", w.Code, w.Body.String())
+		}
+		if _, ok := c.linkSession(token); ok {
+			t.Fatal("link session was kept after a failed login")
+		}
+	})
+	t.Run("subject linked to another user", func(t *testing.T) {
+		other := auth.Identity{UserID: "psid-owner", Username: "viktor", Subject: "authentik-1", LinkedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := c.Identities.Save(other); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Identities.Delete(other.UserID)
+		token := newLink(t, c, user)
+		if w := callback(c, login(t, c, token)); w.Code != http.StatusConflict {
+			t.Fatalf("got %d %s", w.Code, w.Body.String())
+		}
+		postMessage(t, c, user, linkConfirmPayloadPrefix+token)
+		if _, found := linkedIdentity(t, c, user); found {
+			t.Fatal("the same account was linked to two users")
+		}
+	})
+}
+
+func TestExpiredIdentities(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	const user = "psid-expired"
+	identity := auth.Identity{UserID: user, Username: "viktor", Subject: "authentik-1", Groups: []string{"viktor"}, LinkedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour)}
+	if err := c.Identities.Save(identity); err != nil {
+		t.Fatal(err)
+	}
+	if isAdmin(c, user) {
+		t.Fatal("expired identity gave its groups' roles")
+	}
+
+	c.expireIdentities(time.Now())
+	if _, found := linkedIdentity(t, c, user); found {
+		t.Fatal("expired identity was not deleted")
+	}
+	if sent := sendAPI.to(user); len(sent) != 1 || !strings.Contains(sent[0].Text, "expired") {
+		t.Fatalf("got messages %+v, want an expiry notice", sent)
+	}
+}
@@ -0,0 +1,252 @@
+package chatbot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+)
+
+const (
+	approvalRequestsBucket  = "approval_requests"
+	approvalDecisionsBucket = "approval_decisions"
+	approvalVotesBucket     = "approval_votes"
+
+	// How long decided requests are kept so that late button taps can say who decided them
+	decidedApprovalRetention = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrApprovalClosed is returned when voting on a request which has already been decided
+	ErrApprovalClosed = errors.New("approval request has already been decided")
+	// ErrAlreadyVoted is returned when a moderator approves the same request twice
+	ErrAlreadyVoted = errors.New("moderator has already approved this request")
+	// ErrSameGroupVote is returned when distinct groups are required and a moderator's group has already approved
+	ErrSameGroupVote = errors.New("a member of the moderator's group has already approved this request")
+)
+
+// ApprovalDecision is the final outcome of an approval request
+type ApprovalDecision struct {
+	RequestID string        `json:"requestID"`
+	State     ApprovalState `json:"state"`
+	DecidedBy auth.User     `json:"decidedBy"`
+	DecidedAt time.Time     `json:"decidedAt"`
+	// Optional explanation given by the moderator
+	Reason string `json:"reason,omitempty"`
+}
+
+// ApprovalVote is a single moderator's approval of a request which needs more than 1 approval
+type ApprovalVote struct {
+	Moderator auth.User `json:"moderator"`
+	VotedAt   time.Time `json:"votedAt"`
+}
+
+// ApprovalTally is the state of a request after a vote
+type ApprovalTally struct {
+	Approvals []ApprovalVote
+	Required  int
+	// Set if this vote closed the request
+	Decision *ApprovalDecision
+}
+
+// ApprovalLedger stores approval requests and the decisions on them so each request is acted upon at most once
+type ApprovalLedger struct {
+	// serializes Decide calls as moderators tap buttons concurrently
+	mu    sync.Mutex
+	store storage.Store
+}
+
+func NewApprovalLedger(s storage.Store) *ApprovalLedger {
+	return &ApprovalLedger{store: s}
+}
+
+// Save stores an approval request
+func (l *ApprovalLedger) Save(r ApprovalRequest) error {
+	if err := l.store.Put(approvalRequestsBucket, r.ID, r); err != nil {
+		return errors.Wrapf(err, "failed to store approval request %s", r.ID)
+	}
+	return nil
+}
+
+// Request returns the approval request with the given id
+func (l *ApprovalLedger) Request(requestID string) (ApprovalRequest, bool, error) {
+	var r ApprovalRequest
+	found, err := l.store.Get(approvalRequestsBucket, requestID, &r)
+	if err != nil {
+		return ApprovalRequest{}, false, errors.Wrapf(err, "failed to get approval request %s", requestID)
+	}
+	return r, found, nil
+}
+
+// Pending returns all requests which have not been decided yet
+func (l *ApprovalLedger) Pending() ([]ApprovalRequest, error) {
+	ids, err := l.store.Keys(approvalRequestsBucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list approval requests")
+	}
+	res := []ApprovalRequest{}
+	for _, id := range ids {
+		if _, decided, err := l.Get(id); err != nil || decided {
+			continue
+		}
+		r, found, err := l.Request(id)
+		if err != nil || !found {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// Get returns the decision for requestID if one has been made
+func (l *ApprovalLedger) Get(requestID string) (ApprovalDecision, bool, error) {
+	var d ApprovalDecision
+	found, err := l.store.Get(approvalDecisionsBucket, requestID, &d)
+	if err != nil {
+		return ApprovalDecision{}, false, errors.Wrapf(err, "failed to get decision for approval request %s", requestID)
+	}
+	return d, found, nil
+}
+
+// Decide records the decision of moderator on requestID.
+// If the request has already been decided, the existing decision is returned along with false.
+func (l *ApprovalLedger) Decide(requestID string, state ApprovalState, moderator auth.User) (ApprovalDecision, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decide(requestID, state, moderator)
+}
+
+// Vote records the decision of moderator on a request for cmd.
+// A rejection closes the request immediately. Approvals are counted until cmd.RequiredApprovals
+// distinct moderators (from distinct groups if cmd.DistinctGroups is set) have approved.
+// If the request is already decided ErrApprovalClosed is returned along with the decision.
+func (l *ApprovalLedger) Vote(requestID string, state ApprovalState, moderator auth.User, cmd auth.Command) (ApprovalTally, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tally := ApprovalTally{Required: cmd.RequiredApprovals}
+	if tally.Required < 1 {
+		tally.Required = 1
+	}
+	if _, err := l.store.Get(approvalVotesBucket, requestID, &tally.Approvals); err != nil {
+		return tally, errors.Wrapf(err, "failed to get votes for approval request %s", requestID)
+	}
+	existing, found, err := l.Get(requestID)
+	if err != nil {
+		return tally, err
+	}
+	if found {
+		tally.Decision = &existing
+		return tally, ErrApprovalClosed
+	}
+
+	if state == ApprovalStateAccepted {
+		for _, v := range tally.Approvals {
+			if v.Moderator.ID == moderator.ID {
+				return tally, ErrAlreadyVoted
+			}
+			if cmd.DistinctGroups && shareGroup(v.Moderator, moderator) {
+				return tally, ErrSameGroupVote
+			}
+		}
+		tally.Approvals = append(tally.Approvals, ApprovalVote{Moderator: moderator, VotedAt: time.Now()})
+		if err := l.store.Put(approvalVotesBucket, requestID, tally.Approvals); err != nil {
+			return tally, errors.Wrapf(err, "failed to record vote for approval request %s", requestID)
+		}
+		if len(tally.Approvals) < tally.Required {
+			return tally, nil
+		}
+	}
+	d, _, err := l.decide(requestID, state, moderator)
+	if err != nil {
+		return tally, err
+	}
+	tally.Decision = &d
+	return tally, nil
+}
+
+// SetReason attaches the moderator's explanation to an existing decision
+func (l *ApprovalLedger) SetReason(requestID, reason string) (ApprovalDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, found, err := l.Get(requestID)
+	if err != nil {
+		return ApprovalDecision{}, err
+	}
+	if !found {
+		return ApprovalDecision{}, errors.Errorf("approval request %s has not been decided", requestID)
+	}
+	d.Reason = reason
+	if err := l.store.Put(approvalDecisionsBucket, requestID, d); err != nil {
+		return ApprovalDecision{}, errors.Wrapf(err, "failed to store reason for approval request %s", requestID)
+	}
+	return d, nil
+}
+
+// Prune deletes the requests decided more than retention before now along with their decisions and votes.
+// Their buttons then answer that the request no longer exists. Returns the number of deleted requests
+func (l *ApprovalLedger) Prune(now time.Time, retention time.Duration) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ids, err := l.store.Keys(approvalDecisionsBucket)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to list approval decisions")
+	}
+	pruned := 0
+	for _, id := range ids {
+		d, found, err := l.Get(id)
+		if err != nil {
+			return pruned, err
+		}
+		if !found || now.Sub(d.DecidedAt) < retention {
+			continue
+		}
+		// the decision goes last so that a failed prune is retried on the next run
+		for _, bucket := range []string{approvalRequestsBucket, approvalVotesBucket, approvalDecisionsBucket} {
+			if err := l.store.Delete(bucket, id); err != nil {
+				return pruned, errors.Wrapf(err, "failed to delete approval request %s", id)
+			}
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// shareGroup returns true if a and b are members of a common group.
+// Users without groups are considered to be in a group of their own.
+func shareGroup(a, b auth.User) bool {
+	if a.ID == b.ID {
+		return true
+	}
+	for _, ga := range a.Groups {
+		for _, gb := range b.Groups {
+			if ga.Name == gb.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decide must be called with l.mu held
+func (l *ApprovalLedger) decide(requestID string, state ApprovalState, moderator auth.User) (ApprovalDecision, bool, error) {
+	existing, found, err := l.Get(requestID)
+	if err != nil {
+		return ApprovalDecision{}, false, err
+	}
+	if found {
+		return existing, false, nil
+	}
+	d := ApprovalDecision{
+		RequestID: requestID,
+		State:     state,
+		// roles and groups are not needed to tell who made the decision
+		DecidedBy: auth.User{ID: moderator.ID, Name: moderator.Name},
+		DecidedAt: time.Now(),
+	}
+	if err := l.store.Put(approvalDecisionsBucket, requestID, d); err != nil {
+		return ApprovalDecision{}, false, errors.Wrapf(err, "failed to record decision for approval request %s", requestID)
+	}
+	return d, true, nil
+}
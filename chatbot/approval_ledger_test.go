@@ -0,0 +1,204 @@
+package chatbot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+)
+
+func newTestLedger(t *testing.T) *ApprovalLedger {
+	store, err := storage.NewFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewApprovalLedger(store)
+}
+
+func pendingIDs(t *testing.T, l *ApprovalLedger) map[string]bool {
+	pending, err := l.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]bool{}
+	for _, r := range pending {
+		res[r.ID] = true
+	}
+	return res
+}
+
+func TestApprovalLedgerDecidesOnce(t *testing.T) {
+	l := newTestLedger(t)
+	for _, id := range []string{"a", "b"} {
+		if err := l.Save(ApprovalRequest{ID: id, CmdID: "cmd", CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both buttons are tapped at the same time by different moderators
+	var wg sync.WaitGroup
+	recorded := make(chan ApprovalDecision, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state := ApprovalStateAccepted
+			if i%2 == 1 {
+				state = ApprovalStateRejected
+			}
+			d, ok, err := l.Decide("a", state, auth.User{ID: "moderator", Name: "Moderator"})
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				recorded <- d
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(recorded)
+	if len(recorded) != 1 {
+		t.Fatalf("%d decisions were recorded for one request", len(recorded))
+	}
+	first := <-recorded
+	got, found, err := l.Get("a")
+	if err != nil || !found || got.State != first.State {
+		t.Fatalf("got decision %+v %v %v, want %+v", got, found, err, first)
+	}
+	if pending := pendingIDs(t, l); pending["a"] || !pending["b"] {
+		t.Fatalf("got pending %v", pending)
+	}
+
+	if _, err := l.SetReason("a", "not now"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.SetReason("b", "undecided"); err == nil {
+		t.Fatal("set the reason of an undecided request")
+	}
+}
+
+func TestApprovalLedgerPrune(t *testing.T) {
+	l := newTestLedger(t)
+	for _, id := range []string{"first", "second", "pending"} {
+		if err := l.Save(ApprovalRequest{ID: id, CmdID: "cmd", CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"first", "second"} {
+		if _, _, err := l.Decide(id, ApprovalStateRejected, approvalTimeoutModerator); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := l.Prune(time.Now().Add(decidedApprovalRetention-time.Minute), decidedApprovalRetention)
+	if err != nil || pruned != 0 {
+		t.Fatalf("pruned %d requests before the retention period: %v", pruned, err)
+	}
+	pruned, err = l.Prune(time.Now().Add(decidedApprovalRetention), decidedApprovalRetention)
+	if err != nil || pruned != 2 {
+		t.Fatalf("pruned %d requests: %v", pruned, err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if _, found, _ := l.Request(id); found {
+			t.Errorf("request %s was kept", id)
+		}
+		if _, found, _ := l.Get(id); found {
+			t.Errorf("decision on %s was kept", id)
+		}
+	}
+	if pending := pendingIDs(t, l); !pending["pending"] || len(pending) != 1 {
+		t.Fatalf("got pending %v, the undecided request must be kept", pending)
+	}
+}
+
+func TestApprovalLedgerQuorum(t *testing.T) {
+	ops := auth.Group{Name: "ops"}
+	alice := auth.User{ID: "alice", Name: "Alice", Groups: []auth.Group{ops}}
+	bob := auth.User{ID: "bob", Name: "Bob", Groups: []auth.Group{ops}}
+	carol := auth.User{ID: "carol", Name: "Carol", Groups: []auth.Group{{Name: "security"}}}
+	type vote struct {
+		moderator auth.User
+		state     ApprovalState
+		wantErr   error
+		// number of approvals after the vote
+		wantApprovals int
+		// ApprovalStatePending if the request must still be open
+		wantDecision ApprovalState
+	}
+	tests := []struct {
+		name  string
+		cmd   auth.Command
+		votes []vote
+	}{
+		{
+			name: "single approval by default",
+			cmd:  auth.Command{ID: "cmd"},
+			votes: []vote{
+				{moderator: alice, state: ApprovalStateAccepted, wantApprovals: 1, wantDecision: ApprovalStateAccepted},
+				{moderator: bob, state: ApprovalStateRejected, wantErr: ErrApprovalClosed, wantApprovals: 1, wantDecision: ApprovalStateAccepted},
+			},
+		},
+		{
+			name: "quorum reached",
+			cmd:  auth.Command{ID: "cmd", RequiredApprovals: 2},
+			votes: []vote{
+				{moderator: alice, state: ApprovalStateAccepted, wantApprovals: 1},
+				{moderator: bob, state: ApprovalStateAccepted, wantApprovals: 2, wantDecision: ApprovalStateAccepted},
+				{moderator: carol, state: ApprovalStateAccepted, wantErr: ErrApprovalClosed, wantApprovals: 2, wantDecision: ApprovalStateAccepted},
+			},
+		},
+		{
+			name: "double vote does not count",
+			cmd:  auth.Command{ID: "cmd", RequiredApprovals: 2},
+			votes: []vote{
+				{moderator: alice, state: ApprovalStateAccepted, wantApprovals: 1},
+				{moderator: alice, state: ApprovalStateAccepted, wantErr: ErrAlreadyVoted, wantApprovals: 1},
+				{moderator: bob, state: ApprovalStateAccepted, wantApprovals: 2, wantDecision: ApprovalStateAccepted},
+			},
+		},
+		{
+			name: "rejection vetoes",
+			cmd:  auth.Command{ID: "cmd", RequiredApprovals: 2},
+			votes: []vote{
+				{moderator: alice, state: ApprovalStateAccepted, wantApprovals: 1},
+				{moderator: bob, state: ApprovalStateRejected, wantApprovals: 1, wantDecision: ApprovalStateRejected},
+				{moderator: carol, state: ApprovalStateAccepted, wantErr: ErrApprovalClosed, wantApprovals: 1, wantDecision: ApprovalStateRejected},
+			},
+		},
+		{
+			name: "distinct groups",
+			cmd:  auth.Command{ID: "cmd", RequiredApprovals: 2, DistinctGroups: true},
+			votes: []vote{
+				{moderator: alice, state: ApprovalStateAccepted, wantApprovals: 1},
+				{moderator: bob, state: ApprovalStateAccepted, wantErr: ErrSameGroupVote, wantApprovals: 1},
+				{moderator: carol, state: ApprovalStateAccepted, wantApprovals: 2, wantDecision: ApprovalStateAccepted},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			if err := l.Save(ApprovalRequest{ID: "req", CmdID: tt.cmd.ID, CreatedAt: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range tt.votes {
+				tally, err := l.Vote("req", v.state, v.moderator, tt.cmd)
+				if err != v.wantErr {
+					t.Fatalf("vote %d by %s: got error %v, want %v", i, v.moderator.Name, err, v.wantErr)
+				}
+				if len(tally.Approvals) != v.wantApprovals {
+					t.Fatalf("vote %d by %s: got %d approvals, want %d", i, v.moderator.Name, len(tally.Approvals), v.wantApprovals)
+				}
+				if v.wantDecision == ApprovalStatePending {
+					if tally.Decision != nil {
+						t.Fatalf("vote %d by %s: decided %+v before the quorum", i, v.moderator.Name, tally.Decision)
+					}
+				} else if tally.Decision == nil || tally.Decision.State != v.wantDecision {
+					t.Fatalf("vote %d by %s: got decision %+v, want %s", i, v.moderator.Name, tally.Decision, v.wantDecision)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package chatbot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+)
+
+/* Approval tokens are what the Approve/Deny buttons send back as postback payload.
+Anyone can type arbitrary text to the bot, so the token carries nothing but a reference to
+the server side ApprovalRequest and the decision, signed with HMAC-SHA256:
+
+	approval:<request id>.<decision>.<signature>
+*/
+
+const (
+	approvalTokenPrefix = "approval:"
+
+	approvalSigningKeyEnvVar = "APPROVAL_SIGNING_KEY"
+)
+
+var (
+	approvalSigningKey     []byte
+	approvalSigningKeyOnce sync.Once
+)
+
+// approvalToken is the verified content of an approval button payload
+type approvalToken struct {
+	RequestID string
+	State     ApprovalState
+}
+
+func loadApprovalSigningKey() []byte {
+	if key := os.Getenv(approvalSigningKeyEnvVar); key != "" {
+		return []byte(key)
+	}
+	if fbapi.AppSecret != "" {
+		return []byte(fbapi.AppSecret)
+	}
+	glog.Warningf("neither %s nor FB_APP_SECRET is set, using a random approval signing key. Pending approval buttons will stop working after a restart", approvalSigningKeyEnvVar)
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		glog.Fatalf("failed to generate approval signing key: %s", err.Error())
+	}
+	return key
+}
+
+func approvalTokenSignature(requestID string, state ApprovalState) []byte {
+	// loaded lazily so that loadApprovalSigningKey logs after flags are parsed
+	approvalSigningKeyOnce.Do(func() { approvalSigningKey = loadApprovalSigningKey() })
+	mac := hmac.New(sha256.New, approvalSigningKey)
+	mac.Write([]byte(fmt.Sprintf("%s.%d", requestID, state)))
+	return mac.Sum(nil)
+}
+
+func signApprovalToken(requestID string, state ApprovalState) string {
+	sig := base64.RawURLEncoding.EncodeToString(approvalTokenSignature(requestID, state))
+	return fmt.Sprintf("%s%s.%d.%s", approvalTokenPrefix, requestID, state, sig)
+}
+
+// parseApprovalToken returns the token content iff the signature is valid
+func parseApprovalToken(payload string) (approvalToken, error) {
+	parts := strings.Split(strings.TrimPrefix(payload, approvalTokenPrefix), ".")
+	if !strings.HasPrefix(payload, approvalTokenPrefix) || len(parts) != 3 {
+		return approvalToken{}, fmt.Errorf("malformed approval token")
+	}
+	state, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return approvalToken{}, fmt.Errorf("malformed decision in approval token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return approvalToken{}, fmt.Errorf("malformed signature in approval token")
+	}
+	if !hmac.Equal(sig, approvalTokenSignature(parts[0], ApprovalState(state))) {
+		return approvalToken{}, fmt.Errorf("invalid approval token signature")
+	}
+	return approvalToken{RequestID: parts[0], State: ApprovalState(state)}, nil
+}
@@ -0,0 +1,123 @@
+package chatbot
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalTokens(t *testing.T) {
+	valid := signApprovalToken("req-1", ApprovalStateAccepted)
+	// the signature of a rejection, attached to an approval
+	rejection := signApprovalToken("req-1", ApprovalStateRejected)
+	rejectionSig := rejection[strings.LastIndex(rejection, ".")+1:]
+	otherRequest := signApprovalToken("req-2", ApprovalStateAccepted)
+	otherRequestSig := otherRequest[strings.LastIndex(otherRequest, ".")+1:]
+
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{name: "valid", payload: valid},
+		{name: "decision changed", payload: approvalTokenPrefix + "req-1.1." + rejectionSig, wantErr: "invalid approval token signature"},
+		{name: "request changed", payload: approvalTokenPrefix + "req-1.1." + otherRequestSig, wantErr: "invalid approval token signature"},
+		{name: "made up signature", payload: approvalTokenPrefix + "req-1.1." + base64.RawURLEncoding.EncodeToString([]byte("forged")), wantErr: "invalid approval token signature"},
+		{name: "no signature", payload: approvalTokenPrefix + "req-1.1.", wantErr: "invalid approval token signature"},
+		{name: "unsigned legacy payload", payload: approvalTokenPrefix + "req-1", wantErr: "malformed approval token"},
+		{name: "bad decision", payload: approvalTokenPrefix + "req-1.yes." + otherRequestSig, wantErr: "malformed decision"},
+		{name: "bad signature encoding", payload: approvalTokenPrefix + "req-1.1.!!", wantErr: "malformed signature"},
+		{name: "no prefix", payload: strings.TrimPrefix(valid, approvalTokenPrefix), wantErr: "malformed approval token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseApprovalToken(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %+v, error %v, want '%s'", token, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || token.RequestID != "req-1" || token.State != ApprovalStateAccepted {
+				t.Fatalf("got %+v %v", token, err)
+			}
+		})
+	}
+}
+
+// requestApproval asks the approvers of the command with cmdID to let requester run it and returns the request
+func requestApproval(t *testing.T, c *ChatbotHandler, requester, cmdID, input string) ApprovalRequest {
+	what, err := c.cmdFromId(cmdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sendRequestApprovalRequest(c.RBAC().WhoAmI(requester), what, input, nil); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := c.Approvals.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range pending {
+		if r.From.ID == requester && r.CmdID == cmdID {
+			return r
+		}
+	}
+	t.Fatalf("no pending request of %s", requester)
+	return ApprovalRequest{}
+}
+
+func jobsOf(t *testing.T, c *ChatbotHandler, userID string) int {
+	jobs, err := c.Jobs.ForUser(userID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(jobs)
+}
+
+func TestForgedApprovalTokenIsIgnored(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	const requester = "psid-forger"
+	req := requestApproval(t, c, requester, "setup_wireguard", "laptop")
+
+	// the requester approves their own request with a token they made up
+	postMessage(t, c, requester, approvalTokenPrefix+req.ID+".1.c2lnbmF0dXJl")
+	// an approver's valid token for another request does not work for this one
+	other := signApprovalToken("urn:uuid:other", ApprovalStateAccepted)
+	postMessage(t, c, testAdminID, approvalTokenPrefix+req.ID+".1."+other[strings.LastIndex(other, ".")+1:])
+
+	if _, decided, _ := c.Approvals.Get(req.ID); decided {
+		t.Fatal("a forged token decided the request")
+	}
+	if n := jobsOf(t, c, requester); n != 0 {
+		t.Fatalf("a forged token started %d jobs", n)
+	}
+	sent := sendAPI.to(requester)
+	if last := sent[len(sent)-1]; last.Text != "Invalid approval request" {
+		t.Fatalf("got %q for a forged token", last.Text)
+	}
+}
+
+func TestExpiredApprovalTokenIsIgnored(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	const requester = "psid-late"
+	req := requestApproval(t, c, requester, "setup_wireguard", "laptop")
+	approve := signApprovalToken(req.ID, ApprovalStateAccepted)
+
+	c.processPendingApprovals(req.CreatedAt.Add(24 * time.Hour))
+	postMessage(t, c, testAdminID, approve)
+
+	if d, _, _ := c.Approvals.Get(req.ID); d.State != ApprovalStateExpired {
+		t.Fatalf("request is %s after the approval timeout, want it to stay expired", d.State)
+	}
+	if n := jobsOf(t, c, requester); n != 0 {
+		t.Fatalf("approving an expired request started %d jobs", n)
+	}
+	sent := sendAPI.to(testAdminID)
+	if last := sent[len(sent)-1]; !strings.Contains(last.Text, "has already been Expired") {
+		t.Fatalf("got %q when approving an expired request", last.Text)
+	}
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+// Explanation tells how a user got each of the permissions needed for something, or which ones they lack
+type Explanation struct {
+	User User
+	// What the permissions are needed for e.g "run command 'setup_wireguard'"
+	Subject     string
+	Allowed     bool
+	Permissions []PermissionExplanation
+}
+
+// PermissionExplanation is how a single permission is resolved for a user
+type PermissionExplanation struct {
+	Permission string
+	// Path from the user to the permission e.g user -> group -> role -> permission. Empty if the user lacks it
+	Chain []string
+	// Group the user has the permission through, empty if they have it through their own roles or grants
+	Group string
+	// Roles which have the permission. Only set if the user lacks it
+	GrantedBy []string
+}
+
+// Explain resolves each of ps for user the same way IsAllowedMany does
+func (c RBACConfig) Explain(user User, subject string, ps []gorbac.Permission) Explanation {
+	res := Explanation{User: user, Subject: subject, Allowed: true}
+	for _, p := range ps {
+		e := c.explainPermission(user, p)
+		res.Allowed = res.Allowed && len(e.Chain) > 0
+		res.Permissions = append(res.Permissions, e)
+	}
+	return res
+}
+
+// ExplainCommand explains whether user can run cmd without approval
+func (c RBACConfig) ExplainCommand(user User, cmd Command) Explanation {
+	return c.Explain(user, fmt.Sprintf("run command '%s'", cmd.ID), ToPermissions(cmd.Permissions))
+}
+
+type explainStep struct {
+	id    string
+	chain []string
+	// the user's group this step was reached through
+	group string
+}
+
+// explainPermission finds the shortest path from user to p, through their grants and linked groups too
+func (c RBACConfig) explainPermission(user User, p gorbac.Permission) PermissionExplanation {
+	res := PermissionExplanation{Permission: p.ID()}
+	userLabel := fmt.Sprintf("user '%s'(ID: %s)", user.Name, user.ID)
+	queue := []explainStep{{id: user.ID, chain: []string{userLabel}}}
+	now := time.Now()
+	for _, g := range c.Grants {
+		if g.UserID == user.ID && g.Active(now) {
+			grantLabel := fmt.Sprintf("grant %s %s", g.ID, g.Until())
+			queue = append(queue, explainStep{id: g.Role, chain: []string{userLabel, grantLabel, c.nodeLabel(g.Role)}})
+		}
+	}
+	for _, g := range c.linkedGroups(user.ID) {
+		identity, _ := c.identity(user.ID)
+		identityLabel := fmt.Sprintf("Authentik account '%s'", identity.Username)
+		queue = append(queue, explainStep{id: g.Name, chain: []string{userLabel, identityLabel, c.nodeLabel(g.Name)}, group: g.Name})
+	}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if seen[s.id] || c.RBAC == nil {
+			continue
+		}
+		seen[s.id] = true
+		role, parents, err := c.RBAC.Get(s.id)
+		if err != nil {
+			continue
+		}
+		if match := matchingPermission(role, p); match != "" {
+			res.Chain = append(s.chain, match)
+			res.Group = s.group
+			return res
+		}
+		sort.Strings(parents)
+		for _, parent := range parents {
+			chain := append(append([]string{}, s.chain...), c.nodeLabel(parent))
+			group := s.group
+			if s.id == user.ID && c.isGroup(parent) {
+				group = parent
+			}
+			queue = append(queue, explainStep{id: parent, chain: chain, group: group})
+		}
+	}
+	for _, r := range c.Roles {
+		if c.RoleIsAllowed(r.Name, p) {
+			res.GrantedBy = append(res.GrantedBy, r.Name)
+		}
+	}
+	sort.Strings(res.GrantedBy)
+	return res
+}
+
+// matchingPermission describes the permission of role which matches p, or returns "" if none does.
+// Parents are not checked
+func matchingPermission(role gorbac.Role, p gorbac.Permission) string {
+	std, ok := role.(*gorbac.StdRole)
+	if !ok {
+		return ""
+	}
+	ids := []string{}
+	for _, rp := range std.Permissions() {
+		if rp.Match(p) {
+			ids = append(ids, rp.ID())
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id == p.ID() {
+			return fmt.Sprintf("permission '%s'", id)
+		}
+	}
+	return fmt.Sprintf("permission '%s' (matches '%s')", p.ID(), ids[0])
+}
+
+// nodeLabel describes a gorbac role created by initRBAC
+func (c RBACConfig) nodeLabel(id string) string {
+	for _, u := range c.Users {
+		if u.ID == id {
+			return fmt.Sprintf("user '%s'(ID: %s)", u.Name, u.ID)
+		}
+	}
+	if c.isGroup(id) {
+		return fmt.Sprintf("group '%s'", id)
+	}
+	return fmt.Sprintf("role '%s'", id)
+}
+
+func (c RBACConfig) isGroup(id string) bool {
+	_, ok := c.group(id)
+	return ok
+}
+
+// Missing returns the permissions the user lacks along with the roles which have them
+func (e Explanation) Missing() []string {
+	res := []string{}
+	for _, p := range e.Permissions {
+		if len(p.Chain) > 0 {
+			continue
+		}
+		if len(p.GrantedBy) == 0 {
+			res = append(res, fmt.Sprintf("'%s' which no role has", p.Permission))
+		} else {
+			res = append(res, fmt.Sprintf("'%s' which role %s has", p.Permission, strings.Join(quoteAll(p.GrantedBy), " or ")))
+		}
+	}
+	return res
+}
+
+func (e Explanation) String() string {
+	verdict := "can"
+	if !e.Allowed {
+		verdict = "cannot"
+	}
+	lines := []string{fmt.Sprintf("User '%s'(ID: %s) %s %s", e.User.Name, e.User.ID, verdict, e.Subject)}
+	if len(e.Permissions) == 0 {
+		lines = append(lines, "- no permissions are required")
+	}
+	for _, p := range e.Permissions {
+		switch {
+		case len(p.Chain) > 0:
+			lines = append(lines, fmt.Sprintf("- '%s': %s", p.Permission, strings.Join(p.Chain, " -> ")))
+		case len(p.GrantedBy) > 0:
+			lines = append(lines, fmt.Sprintf("- '%s': missing, granted by role %s", p.Permission, strings.Join(quoteAll(p.GrantedBy), ", ")))
+		default:
+			lines = append(lines, fmt.Sprintf("- '%s': missing, no role grants it", p.Permission))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func quoteAll(ss []string) []string {
+	res := []string{}
+	for _, s := range ss {
+		res = append(res, fmt.Sprintf("'%s'", s))
+	}
+	return res
+}
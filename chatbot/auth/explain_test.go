@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	shippedConfig = "../config/viktorwebservices.yaml"
+	// the config admin, an admin through group "viktor"
+	shippedAdminID = "3804650372987546"
+)
+
+// assertGolden compares got to testdata/name, or writes it there with -update
+func assertGolden(t *testing.T, name, got string) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Fatalf("got\n%s\nwant\n%s\nrun go test -update if the change is intended", got, want)
+	}
+}
+
+func TestExplainShippedConfig(t *testing.T) {
+	rbac, err := NewRBACConfig(shippedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wireguard Command
+	for _, c := range rbac.Commands {
+		if c.ID == "setup_wireguard" {
+			wireguard = c
+		}
+	}
+	const guestID, friendID = "42", "43"
+	// fixed times so the output does not change, the grant is active until then
+	granted := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rbac.Grants = []Grant{{ID: "g1", UserID: friendID, Role: "friend", GrantedAt: granted, ExpiresAt: granted.AddDate(100, 0, 0)}}
+	permission := func(id string) []gorbac.Permission {
+		return []gorbac.Permission{NewPermission(id)}
+	}
+	tests := []struct {
+		golden      string
+		explanation Explanation
+	}{
+		{golden: "explain-admin-command.golden", explanation: rbac.ExplainCommand(rbac.WhoAmI(shippedAdminID), wireguard)},
+		{golden: "explain-guest-command.golden", explanation: rbac.ExplainCommand(rbac.WhoAmI(guestID), wireguard)},
+		{golden: "explain-grant-command.golden", explanation: rbac.ExplainCommand(rbac.WhoAmI(friendID), wireguard)},
+		{golden: "explain-admin-permission.golden", explanation: rbac.Explain(rbac.WhoAmI(shippedAdminID), "use permission 'manage-grants'", permission("manage-grants"))},
+		{golden: "explain-guest-permission.golden", explanation: rbac.Explain(rbac.WhoAmI(guestID), "use permission 'get-info'", permission("get-info"))},
+		{golden: "explain-no-permissions.golden", explanation: rbac.Explain(rbac.WhoAmI(guestID), "enter state 'Hello'", nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			assertGolden(t, tt.golden, tt.explanation.String()+"\n")
+		})
+	}
+}
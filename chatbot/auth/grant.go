@@ -0,0 +1,40 @@
+package auth
+
+import "time"
+
+// Grant gives a user a role until it expires. Grants are issued from chat and stored outside the config file
+type Grant struct {
+	ID     string `json:"id"`
+	UserID string `json:"userID"`
+	Role   string `json:"role"`
+	// roles and groups are not needed to tell who issued the grant
+	GrantedBy User      `json:"grantedBy"`
+	GrantedAt time.Time `json:"grantedAt"`
+	// Zero if the grant lasts until it is revoked
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Active returns true if the grant has not expired at now
+func (g Grant) Active(now time.Time) bool {
+	return g.ExpiresAt.IsZero() || now.Before(g.ExpiresAt)
+}
+
+// Until describes when the grant ends e.g "until Mon, 02 Jan 2006 15:04:05 MST"
+func (g Grant) Until() string {
+	if g.ExpiresAt.IsZero() {
+		return "until revoked"
+	}
+	return "until " + g.ExpiresAt.Format(time.RFC1123)
+}
+
+// activeGrants returns the roles granted to userID which have not expired yet
+func (c RBACConfig) activeGrants(userID string) []string {
+	now := time.Now()
+	res := []string{}
+	for _, g := range c.Grants {
+		if g.UserID == userID && g.Active(now) {
+			res = append(res, g.Role)
+		}
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+package auth
+
+import "time"
+
+// Identity binds a Messenger user to an account at the identity provider (Authentik).
+// Identities are created by logging in from chat and stored outside the config file
+type Identity struct {
+	// PSID of the Messenger user
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	// Subject of the ID token, stable even if the username changes
+	Subject string `json:"subject"`
+	// Groups from the ID token. Only the ones defined in the config file give permissions
+	Groups   []string  `json:"groups"`
+	LinkedAt time.Time `json:"linkedAt"`
+	// Groups change at the identity provider, so the user has to link again after this
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Active returns true if the identity has not expired at now
+func (i Identity) Active(now time.Time) bool {
+	return now.Before(i.ExpiresAt)
+}
+
+// identity returns the linked identity of userID, if any. Expired identities are ignored
+func (c RBACConfig) identity(userID string) (Identity, bool) {
+	now := time.Now()
+	for _, i := range c.Identities {
+		if i.UserID == userID && i.Active(now) {
+			return i, true
+		}
+	}
+	return Identity{}, false
+}
+
+// linkedGroups returns the groups of the config file userID is a member of through their linked identity
+func (c RBACConfig) linkedGroups(userID string) []Group {
+	identity, ok := c.identity(userID)
+	if !ok {
+		return nil
+	}
+	res := []Group{}
+	for _, name := range identity.Groups {
+		if g, ok := c.group(name); ok {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// group returns the group defined at the top level or inline in a user
+func (c RBACConfig) group(name string) (Group, bool) {
+	for _, g := range c.Groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	for _, u := range c.Users {
+		for _, g := range u.Groups {
+			if g.Name == name {
+				return g, true
+			}
+		}
+	}
+	return Group{}, false
+}
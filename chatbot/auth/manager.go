@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"reflect"
 
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
+
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"github.com/viktorbarzin/gorbac"
@@ -37,18 +39,38 @@ func NewRBACConfig(configFile string) (RBACConfig, error) {
 		return RBACConfig{}, errors.Errorf("did not find valid RBAC config in file %s. Err: %s", configFile, err.Error())
 	}
 
-	// Add guest user
-	rbacYaml.Users = append(rbacYaml.Users, GuestUser())
+	// Add guest user unless the config defines one
+	if !hasUser(rbacYaml.Users, GuestUserID) {
+		rbacYaml.Users = append(rbacYaml.Users, GuestUser())
+	}
 
-	// Remove duplicates
-	rbacYaml.Users = uniqueUsers(rbacYaml.Users)
-	rbacYaml.Commands = uniqueCommands(rbacYaml.Commands)
-	rbacYaml.Permissions = uniquePermissions(rbacYaml.Permissions)
-	rbacYaml.Roles = uniqueRoles(rbacYaml.Roles)
-	rbacYaml.Groups = uniqueGroups(rbacYaml.Groups)
+	// Remove exact duplicates (e.g an anchor listed twice), conflicting ones are an error
+	if rbacYaml.Users, err = uniqueUsers(rbacYaml.Users); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid users in config file %s", configFile)
+	}
+	if rbacYaml.Commands, err = uniqueCommands(rbacYaml.Commands); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid commands in config file %s", configFile)
+	}
+	if rbacYaml.Permissions, err = uniquePermissions(rbacYaml.Permissions); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid permissions in config file %s", configFile)
+	}
+	if rbacYaml.Roles, err = uniqueRoles(rbacYaml.Roles); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid roles in config file %s", configFile)
+	}
+	if rbacYaml.Groups, err = uniqueGroups(rbacYaml.Groups); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid groups in config file %s", configFile)
+	}
+
+	for _, c := range rbacYaml.Commands {
+		if err := validation.CheckRules(c.Validators); err != nil {
+			return RBACConfig{}, errors.Wrapf(err, "invalid validators for command '%s'", c.ID)
+		}
+	}
 
 	rbac := gorbac.New()
-	initRBAC(rbac, rbacYaml.Users)
+	if err := initRBAC(rbac, rbacYaml); err != nil {
+		return RBACConfig{}, errors.Wrapf(err, "invalid roles in config file %s", configFile)
+	}
 	rbacYaml.RBAC = rbac
 
 	// p := rbacYaml.Permissions[0]
@@ -59,74 +81,100 @@ func NewRBACConfig(configFile string) (RBACConfig, error) {
 	return rbacYaml, nil
 }
 
-func uniqueUsers(users []User) []User {
-	check := map[string]bool{}
+func hasUser(users []User, id string) bool {
 	for _, u := range users {
-		check[u.ID] = true
+		if u.ID == id {
+			return true
+		}
 	}
-	res := []User{}
-	for _, v := range users {
-		if _, ok := check[v.ID]; ok {
-			res = append(res, v)
+	return false
+}
+
+// uniqueIndices returns the indices of the first occurrence of each id among n items.
+// Later items with the same id must be equal to the first one, otherwise an error naming the id is returned.
+func uniqueIndices(kind string, n int, id func(i int) string, equal func(i, j int) bool) ([]int, error) {
+	first := map[string]int{}
+	res := []int{}
+	for i := 0; i < n; i++ {
+		j, ok := first[id(i)]
+		if !ok {
+			first[id(i)] = i
+			res = append(res, i)
+			continue
+		}
+		if !equal(i, j) {
+			return nil, errors.Errorf("%s '%s' is defined more than once with different content", kind, id(i))
 		}
 	}
-	return res
+	return res, nil
 }
 
-func uniqueCommands(commands []Command) []Command {
-	check := map[string]bool{}
-	for _, u := range commands {
-		check[u.ID] = true
+func uniqueUsers(users []User) ([]User, error) {
+	keep, err := uniqueIndices("user", len(users),
+		func(i int) string { return users[i].ID },
+		func(i, j int) bool { return reflect.DeepEqual(users[i], users[j]) })
+	if err != nil {
+		return nil, err
 	}
-	res := []Command{}
-	for _, v := range commands {
-		if _, ok := check[v.ID]; ok {
-			res = append(res, v)
-		}
+	res := []User{}
+	for _, i := range keep {
+		res = append(res, users[i])
 	}
-	return res
+	return res, nil
 }
 
-func uniquePermissions(permissions []gorbac.StdPermission) []gorbac.StdPermission {
-	check := map[string]bool{}
-	for _, u := range permissions {
-		check[u.ID()] = true
+func uniqueCommands(commands []Command) ([]Command, error) {
+	keep, err := uniqueIndices("command", len(commands),
+		func(i int) string { return commands[i].ID },
+		func(i, j int) bool { return reflect.DeepEqual(commands[i], commands[j]) })
+	if err != nil {
+		return nil, err
+	}
+	res := []Command{}
+	for _, i := range keep {
+		res = append(res, commands[i])
 	}
+	return res, nil
+}
+
+func uniquePermissions(permissions []gorbac.StdPermission) ([]gorbac.StdPermission, error) {
+	// permissions are equal iff their ids are
+	keep, _ := uniqueIndices("permission", len(permissions),
+		func(i int) string { return permissions[i].ID() },
+		func(i, j int) bool { return true })
 	res := []gorbac.StdPermission{}
-	for _, v := range permissions {
-		if _, ok := check[v.ID()]; ok {
-			res = append(res, v)
-		}
+	for _, i := range keep {
+		res = append(res, permissions[i])
 	}
-	return res
+	return res, nil
 }
 
-func uniqueRoles(roles []Role) []Role {
-	check := map[string]bool{}
-	for _, u := range roles {
-		check[u.Name] = true
+func uniqueRoles(roles []Role) ([]Role, error) {
+	keep, err := uniqueIndices("role", len(roles),
+		func(i int) string { return roles[i].Name },
+		func(i, j int) bool { return reflect.DeepEqual(roles[i], roles[j]) })
+	if err != nil {
+		return nil, err
 	}
 	res := []Role{}
-	for _, v := range roles {
-		if _, ok := check[v.Name]; ok {
-			res = append(res, v)
-		}
+	for _, i := range keep {
+		res = append(res, roles[i])
 	}
-	return res
+	return res, nil
 }
 
-func uniqueGroups(groups []Group) []Group {
-	check := map[string]bool{}
-	for _, u := range groups {
-		check[u.Name] = true
+func uniqueGroups(groups []Group) ([]Group, error) {
+	keep, err := uniqueIndices("group", len(groups),
+		func(i int) string { return groups[i].Name },
+		func(i, j int) bool { return reflect.DeepEqual(groups[i], groups[j]) })
+	if err != nil {
+		return nil, err
 	}
 	res := []Group{}
-	for _, v := range groups {
-		if _, ok := check[v.Name]; ok {
-			res = append(res, v)
-		}
+	for _, i := range keep {
+		res = append(res, groups[i])
 	}
-	return res
+	return res, nil
 }
 
 func ToPermissions(ps []gorbac.StdPermission) []gorbac.Permission {
@@ -137,35 +185,121 @@ func ToPermissions(ps []gorbac.StdPermission) []gorbac.Permission {
 	return res
 }
 
-func initRBAC(rbac *gorbac.RBAC, users []User) {
-	// Init roles and permissions
-	for _, u := range users {
-		userRole := gorbac.NewStdRole(u.ID)
-		rbac.Add(userRole)
+// AllRoles returns the roles defined at the top level and inline in users and groups in the order they first appear.
+// Top level definitions take precedence over inline ones
+func (c RBACConfig) AllRoles() []Role {
+	roles := map[string]Role{}
+	order := []string{}
+	addRole := func(r Role) {
+		if _, ok := roles[r.Name]; !ok {
+			order = append(order, r.Name)
+		}
+		roles[r.Name] = r
+	}
+	for _, u := range c.Users {
 		for _, r := range u.Roles {
-			role := gorbac.NewStdRole(r.Name)
-			for _, p := range r.Permissions {
-				perm := gorbac.NewStdPermission(p.ID())
-				role.Assign(perm)
-			}
-			rbac.Add(role)
-			rbac.SetParent(userRole.ID(), role.ID())
+			addRole(r)
 		}
 		for _, g := range u.Groups {
-			groupRole := gorbac.NewStdRole(g.Name)
-			rbac.Add(groupRole)
 			for _, r := range g.Roles {
-				gRole := gorbac.NewStdRole(r.Name)
-				for _, p := range r.Permissions {
-					perm := gorbac.NewStdPermission(p.ID())
-					gRole.Assign(perm)
+				addRole(r)
+			}
+		}
+	}
+	for _, g := range c.Groups {
+		for _, r := range g.Roles {
+			addRole(r)
+		}
+	}
+	for _, r := range c.Roles {
+		addRole(r)
+	}
+	res := make([]Role, 0, len(order))
+	for _, name := range order {
+		res = append(res, roles[name])
+	}
+	return res
+}
+
+// FindRole returns the role named name, wherever it is defined
+func (c RBACConfig) FindRole(name string) (Role, bool) {
+	for _, r := range c.AllRoles() {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Role{}, false
+}
+
+// initRBAC adds a gorbac role for every role, group and user. Groups inherit from their roles,
+// users from their roles and groups and roles from their parents
+func initRBAC(rbac *gorbac.RBAC, config RBACConfig) error {
+	roles := map[string]Role{}
+	order := []string{}
+	for _, r := range config.AllRoles() {
+		roles[r.Name] = r
+		order = append(order, r.Name)
+	}
+
+	for _, name := range order {
+		role := gorbac.NewStdRole(name)
+		for _, p := range roles[name].Permissions {
+			if IsGlob(p.ID()) {
+				if err := CheckGlob(p.ID()); err != nil {
+					return errors.Wrapf(err, "role '%s'", name)
 				}
-				rbac.Add(gRole)
-				rbac.SetParent(groupRole.ID(), gRole.ID())
 			}
-			rbac.SetParent(userRole.ID(), groupRole.ID())
+			role.Assign(NewPermission(p.ID()))
+		}
+		rbac.Add(role)
+	}
+	for _, name := range order {
+		for _, parent := range roles[name].Parents {
+			if _, ok := roles[parent.Name]; !ok {
+				return errors.Errorf("role '%s' has unknown parent '%s'", name, parent.Name)
+			}
+			rbac.SetParent(name, parent.Name)
+		}
+		if approvedBy := roles[name].ApprovedBy; approvedBy != nil {
+			if _, ok := roles[approvedBy.Name]; !ok {
+				return errors.Errorf("role '%s' is approved by unknown role '%s'", name, approvedBy.Name)
+			}
+		}
+	}
+
+	groups := map[string]Group{}
+	for _, g := range config.Groups {
+		groups[g.Name] = g
+	}
+	for _, u := range config.Users {
+		for _, g := range u.Groups {
+			if _, ok := groups[g.Name]; !ok {
+				groups[g.Name] = g
+			}
 		}
 	}
+	for _, g := range groups {
+		rbac.Add(gorbac.NewStdRole(g.Name))
+		for _, r := range g.Roles {
+			rbac.SetParent(g.Name, r.Name)
+		}
+	}
+
+	for _, u := range config.Users {
+		rbac.Add(gorbac.NewStdRole(u.ID))
+		for _, r := range u.Roles {
+			rbac.SetParent(u.ID, r.Name)
+		}
+		for _, g := range u.Groups {
+			rbac.SetParent(u.ID, g.Name)
+		}
+	}
+
+	// IsGranted recurses forever on cycles
+	if err := gorbac.InherCircle(rbac); err != nil {
+		return errors.Errorf("roles inherit from each other in a cycle, check their parents and that no group is named like a role or user")
+	}
+	return nil
 }
 
 func (c RBACConfig) WhoAmI(userId string) User {
@@ -180,6 +314,13 @@ func (c RBACConfig) WhoAmI(userId string) User {
 		// store guest user
 		res = GuestUserWithId(userId)
 	}
+	if identity, ok := c.identity(userId); ok {
+		if !hasUser(c.Users, userId) {
+			res.Name = identity.Username
+		}
+		// copy so the config's users are not modified
+		res.Groups = append(append([]Group{}, res.Groups...), c.linkedGroups(userId)...)
+	}
 	return res
 }
 
@@ -188,6 +329,16 @@ func (c RBACConfig) IsAllowed(user User, p gorbac.Permission) bool {
 	if c.RBAC.IsGranted(user.ID, p, nil) {
 		return true
 	}
+	for _, role := range c.activeGrants(user.ID) {
+		if c.RBAC.IsGranted(role, p, nil) {
+			return true
+		}
+	}
+	for _, g := range c.linkedGroups(user.ID) {
+		if c.RBAC.IsGranted(g.Name, p, nil) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -238,27 +389,74 @@ func (c RBACConfig) IsAllowedToExecuteMany(user User, cmds []Command) bool {
 
 func (c RBACConfig) UsersInRole(r Role) []User {
 	users := []User{}
+	seen := map[string]bool{}
 	for _, u := range c.Users {
+		seen[u.ID] = true
 		if c.UserHasRole(u, r) {
 			users = append(users, u)
 		}
 	}
+	// users who are not in the config file may have been granted the role or be in a group with it
+	others := []string{}
+	for _, g := range c.Grants {
+		others = append(others, g.UserID)
+	}
+	for _, i := range c.Identities {
+		others = append(others, i.UserID)
+	}
+	for _, id := range others {
+		if u := c.WhoAmI(id); !seen[u.ID] && c.UserHasRole(u, r) {
+			seen[u.ID] = true
+			users = append(users, u)
+		}
+	}
 	return users
 }
 
+// UserHasRole returns true if u has r directly, through one of their groups (linked ones too), an active grant or a role inheriting from r
 func (c RBACConfig) UserHasRole(u User, r Role) bool {
 	for _, ur := range u.Roles {
-		if ur.Name == r.Name {
+		if c.inheritsFrom(ur.Name, r.Name) {
 			return true
 		}
 	}
 
-	for _, ug := range u.Groups {
+	for _, ug := range append(append([]Group{}, u.Groups...), c.linkedGroups(u.ID)...) {
 		for _, ugr := range ug.Roles {
-			if ugr.Name == r.Name {
+			if c.inheritsFrom(ugr.Name, r.Name) {
 				return true
 			}
 		}
 	}
+	for _, role := range c.activeGrants(u.ID) {
+		if c.inheritsFrom(role, r.Name) {
+			return true
+		}
+	}
 	return false
 }
+
+// inheritsFrom returns true if role is ancestor or one of its parents, recursively
+func (c RBACConfig) inheritsFrom(role, ancestor string) bool {
+	seen := map[string]bool{}
+	queue := []string{role}
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if r == ancestor {
+			return true
+		}
+		if seen[r] || c.RBAC == nil {
+			continue
+		}
+		seen[r] = true
+		parents, _ := c.RBAC.GetParents(r)
+		queue = append(queue, parents...)
+	}
+	return false
+}
+
+// RoleIsAllowed returns true if role has p, directly or through its parents
+func (c RBACConfig) RoleIsAllowed(role string, p gorbac.Permission) bool {
+	return c.RBAC.IsGranted(role, p, nil)
+}
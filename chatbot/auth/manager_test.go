@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRBACPrefix = `
+permissions:
+- &perm-a
+  idstr: "a"
+- &perm-b
+  idstr: "b"
+roles:
+- &role-admin
+  id: "admin"
+  permissions:
+    - *perm-a
+`
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "rbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewRBACConfigDuplicateIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// substring of the expected error, empty if the config is valid
+		wantErr string
+		// counts after loading valid configs. The guest user is always added
+		wantUsers, wantRoles, wantGroups, wantCommands, wantPermissions int
+	}{
+		{
+			name: "unique ids",
+			config: testRBACPrefix + `
+users:
+- id: "1"
+  name: "one"
+  roles: [*role-admin]
+`,
+			wantUsers: 2, wantRoles: 1, wantPermissions: 2,
+		},
+		{
+			name: "user anchor listed twice",
+			config: testRBACPrefix + `
+users:
+- &user-one
+  id: "1"
+  name: "one"
+  roles: [*role-admin]
+- *user-one
+`,
+			wantUsers: 2, wantRoles: 1, wantPermissions: 2,
+		},
+		{
+			name: "conflicting users",
+			config: testRBACPrefix + `
+users:
+- id: "1"
+  name: "one"
+- id: "1"
+  name: "impostor"
+  roles: [*role-admin]
+`,
+			wantErr: "user '1' is defined more than once with different content",
+		},
+		{
+			name: "role anchor listed twice",
+			config: testRBACPrefix + `
+- *role-admin
+`,
+			wantUsers: 1, wantRoles: 1, wantPermissions: 2,
+		},
+		{
+			name: "conflicting roles",
+			config: testRBACPrefix + `
+- id: "admin"
+  permissions:
+    - *perm-b
+`,
+			wantErr: "role 'admin' is defined more than once with different content",
+		},
+		{
+			name: "group anchor listed twice",
+			config: testRBACPrefix + `
+groups:
+- &group-ops
+  name: "ops"
+  roles: [*role-admin]
+- *group-ops
+`,
+			wantUsers: 1, wantRoles: 1, wantGroups: 1, wantPermissions: 2,
+		},
+		{
+			name: "conflicting groups",
+			config: testRBACPrefix + `
+groups:
+- name: "ops"
+  roles: [*role-admin]
+- name: "ops"
+`,
+			wantErr: "group 'ops' is defined more than once with different content",
+		},
+		{
+			name: "command anchor listed twice",
+			config: testRBACPrefix + `
+commands:
+- &cmd-echo
+  id: "echo"
+  cmd: "echo $line"
+  approvedBy: *role-admin
+- *cmd-echo
+`,
+			wantUsers: 1, wantRoles: 1, wantCommands: 1, wantPermissions: 2,
+		},
+		{
+			name: "conflicting commands",
+			config: testRBACPrefix + `
+commands:
+- id: "echo"
+  cmd: "echo $line"
+- id: "echo"
+  cmd: "rm -rf $line"
+`,
+			wantErr: "command 'echo' is defined more than once with different content",
+		},
+		{
+			name: "permission listed twice",
+			config: `
+permissions:
+- &perm-a
+  idstr: "a"
+- *perm-a
+- idstr: "a"
+roles:
+- id: "admin"
+  permissions:
+    - *perm-a
+`,
+			wantUsers: 1, wantRoles: 1, wantPermissions: 1,
+		},
+		{
+			name: "guest user defined in the config",
+			config: testRBACPrefix + `
+users:
+- id: "__guest"
+  name: "Guest user"
+  roles: [*role-admin]
+`,
+			wantUsers: 1, wantRoles: 1, wantPermissions: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewRBACConfig(writeConfig(t, tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int{len(c.Users), len(c.Roles), len(c.Groups), len(c.Commands), len(c.Permissions)}
+			want := []int{tt.wantUsers, tt.wantRoles, tt.wantGroups, tt.wantCommands, tt.wantPermissions}
+			for i, kind := range []string{"users", "roles", "groups", "commands", "permissions"} {
+				if got[i] != want[i] {
+					t.Errorf("got %d %s, want %d", got[i], kind, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewRBACConfigRoleGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+		// permission user "1" must have when the config is valid
+		wantAllowed string
+	}{
+		{
+			name: "parent chain",
+			config: testRBACPrefix + `
+- &role-ops
+  id: "ops"
+  parents: [*role-admin]
+users:
+- id: "1"
+  name: "one"
+  roles: [*role-ops]
+`,
+			wantAllowed: "a",
+		},
+		{
+			name: "role is its own parent",
+			config: testRBACPrefix + `
+- id: "ops"
+  parents:
+  - id: "ops"
+`,
+			wantErr: "roles inherit from each other in a cycle",
+		},
+		{
+			name: "roles are each other's parents",
+			config: testRBACPrefix + `
+- id: "ops"
+  parents:
+  - id: "dev"
+- id: "dev"
+  parents:
+  - id: "ops"
+`,
+			wantErr: "roles inherit from each other in a cycle",
+		},
+		{
+			name: "group named like a role it has",
+			config: testRBACPrefix + `
+groups:
+- name: "admin"
+  roles: [*role-admin]
+`,
+			wantErr: "roles inherit from each other in a cycle",
+		},
+		{
+			name: "unknown parent",
+			config: testRBACPrefix + `
+- id: "ops"
+  parents:
+  - id: "root"
+`,
+			wantErr: "role 'ops' has unknown parent 'root'",
+		},
+		{
+			name: "glob permission",
+			config: testRBACPrefix + `
+- &role-all
+  id: "all"
+  permissions:
+  - idstr: "*"
+users:
+- id: "1"
+  name: "one"
+  roles: [*role-all]
+`,
+			wantAllowed: "b",
+		},
+		{
+			name: "malformed glob permission",
+			config: testRBACPrefix + `
+- id: "broken"
+  permissions:
+  - idstr: "b["
+`,
+			wantErr: "invalid permission pattern 'b['",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewRBACConfig(writeConfig(t, tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.IsAllowed(c.WhoAmI("1"), NewPermission(tt.wantAllowed)) {
+				t.Fatalf("user does not have permission '%s'", tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestFindRole(t *testing.T) {
+	c, err := NewRBACConfig(writeConfig(t, testRBACPrefix+`
+groups:
+- name: "ops"
+  roles:
+  - id: "oncall"
+users:
+- id: "1"
+  name: "one"
+  roles:
+  - id: "admin"
+  groups:
+  - name: "devs"
+    roles:
+    - id: "dev"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"admin", "oncall", "dev"} {
+		if _, ok := c.FindRole(name); !ok {
+			t.Errorf("role '%s' was not found", name)
+		}
+	}
+	if _, ok := c.FindRole("root"); ok {
+		t.Error("found a role which is not defined")
+	}
+	// the top level definition wins over the inline mention in user 1
+	if admin, _ := c.FindRole("admin"); len(admin.Permissions) != 1 {
+		t.Errorf("got %+v, want the top level definition", admin)
+	}
+	if n := len(c.AllRoles()); n != 3 {
+		t.Errorf("got %d roles, want 3", n)
+	}
+}
@@ -2,6 +2,10 @@
 package auth
 
 import (
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
+
 	"github.com/viktorbarzin/gorbac"
 )
 
@@ -16,24 +20,68 @@ type RBACConfig struct {
 	Permissions []gorbac.StdPermission `yaml:"permissions" json:"permissions"`
 	Commands    []Command              `yaml:"commands" json:"commands"`
 	RBAC        *gorbac.RBAC
+	// Temporary roles on top of the config file. Expired grants are ignored
+	Grants []Grant `yaml:"-" json:"-"`
+	// Accounts at the identity provider users have linked. Their groups count as the user's groups
+	Identities []Identity `yaml:"-" json:"-"`
 }
 
 // Command is a shell cmd that can be executed by the chatbot
 type Command struct {
-	ID          string                 `yaml:"id" json:"id"`
-	PrettyName  string                 `yaml:"prettyName" json:"prettyName"`
-	CMD         string                 `yaml:"cmd" json:"cmd"`
+	ID         string `yaml:"id" json:"id"`
+	PrettyName string `yaml:"prettyName" json:"prettyName"`
+	// Shell script run once per line of user input which is available as $line
+	CMD string `yaml:"cmd" json:"cmd"`
+	// Program and arguments executed without a shell. If set, CMD is ignored and
+	// user input is passed as described by InputMode instead of being interpolated
+	Argv []string `yaml:"argv" json:"argv"`
+	// How user input is passed to Argv commands: "stdin" (default) or "env" (as $INPUT)
+	InputMode   string                 `yaml:"inputMode" json:"inputMode"`
 	Permissions []gorbac.StdPermission `yaml:"permissions" json:"permissions"`
 	// Message to send the user after the command succeeded
 	SuccessExplanation string `yaml:"onSuccess"`
 	ShowCmdOutput      bool   `yaml:"showCmdOutput" json:"showCmdOutput"`
 	ApprovedBy         Role   `yaml:"approvedBy" json:"approvedBy"`
+	// How long an approval request stays open before it expires. 0 means never
+	ApprovalTimeout time.Duration `yaml:"approvalTimeout" json:"approvalTimeout"`
+	// How often to remind approvers about a pending request. 0 means no reminders
+	ApprovalReminderInterval time.Duration `yaml:"approvalReminderInterval" json:"approvalReminderInterval"`
+	// Send output to the user line by line while the command is running
+	StreamOutput bool `yaml:"streamOutput" json:"streamOutput"`
+	// Kill the command if it runs longer than this. 0 means no timeout
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// Output beyond this many bytes is dropped. 0 means unlimited
+	MaxOutputBytes int            `yaml:"maxOutputBytes" json:"maxOutputBytes"`
+	Limits         ResourceLimits `yaml:"limits" json:"limits"`
+	// Number of distinct `approvedBy` members who must approve before the command is executed. Defaults to 1
+	RequiredApprovals int `yaml:"requiredApprovals" json:"requiredApprovals"`
+	// If set, each of the required approvals must come from a different group
+	DistinctGroups bool `yaml:"distinctGroups" json:"distinctGroups"`
+	// Rules user input must satisfy. Commands without validators accept [a-zA-Z0-9=.@ ]{1,500}
+	Validators []validation.Rule `yaml:"validators" json:"validators"`
+	// Ask the user to confirm their input before executing or requesting approval
+	Confirm bool `yaml:"confirm" json:"confirm"`
+}
+
+// ResourceLimits are rlimits applied to a command's processes. 0 means unlimited
+type ResourceLimits struct {
+	// CPU time in seconds
+	CPUSeconds int `yaml:"cpuSeconds" json:"cpuSeconds"`
+	// Virtual memory in megabytes
+	MemoryMB int `yaml:"memoryMB" json:"memoryMB"`
+	// Max number of processes of the user running the chatbot
+	Processes int `yaml:"processes" json:"processes"`
 }
 
 // Role on the RBAC e.g "admin"
 type Role struct {
-	Name        string                 `yaml:"id" json:"id"` // must be unique
+	Name string `yaml:"id" json:"id"` // must be unique
+	// Permission ids may be patterns e.g "setup-*", see GlobPermission
 	Permissions []gorbac.StdPermission `yaml:"permissions" json:"permissions"`
+	// Roles whose permissions this role inherits. Only the id of each parent is used
+	Parents []Role `yaml:"parents" json:"parents"`
+	// Members of this role decide on requests for it. Roles without it cannot be requested. Only the id is used
+	ApprovedBy *Role `yaml:"approvedBy" json:"approvedBy,omitempty"`
 }
 
 // User is a kind of subject which represents a physical user
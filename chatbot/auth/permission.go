@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/viktorbarzin/gorbac"
+)
+
+// GlobPermission is granted to roles to match every permission whose id matches Pattern e.g "setup-*".
+// Patterns use the syntax of path.Match
+type GlobPermission struct {
+	Pattern string
+}
+
+// NewPermission returns a GlobPermission if id is a pattern and a gorbac.StdPermission otherwise
+func NewPermission(id string) gorbac.Permission {
+	if IsGlob(id) {
+		return GlobPermission{Pattern: id}
+	}
+	return gorbac.NewStdPermission(id)
+}
+
+// IsGlob returns true if id contains any of the pattern characters *, ? or [
+func IsGlob(id string) bool {
+	return strings.ContainsAny(id, "*?[")
+}
+
+// CheckGlob returns an error if pattern is malformed
+func CheckGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Wrapf(err, "invalid permission pattern '%s'", pattern)
+	}
+	return nil
+}
+
+func (p GlobPermission) ID() string {
+	return p.Pattern
+}
+
+func (p GlobPermission) Match(a gorbac.Permission) bool {
+	if p.Pattern == a.ID() {
+		return true
+	}
+	ok, _ := path.Match(p.Pattern, a.ID())
+	return ok
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+func TestGlobPermissionMatch(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		permission string
+		want       bool
+	}{
+		{pattern: "*", permission: "setup-vpn", want: true},
+		{pattern: "setup-*", permission: "setup-vpn", want: true},
+		{pattern: "setup-*", permission: "setup-", want: true},
+		{pattern: "setup-*", permission: "get-info", want: false},
+		{pattern: "setup-?", permission: "setup-a", want: true},
+		{pattern: "setup-?", permission: "setup-ab", want: false},
+		{pattern: "setup-[ab]", permission: "setup-b", want: true},
+		{pattern: "setup-[ab]", permission: "setup-c", want: false},
+		// like path.Match, * and ? do not match across /
+		{pattern: "*", permission: "setup/vpn", want: false},
+		{pattern: "setup/*", permission: "setup/vpn", want: true},
+		{pattern: "setup*", permission: "setup/vpn", want: false},
+		{pattern: "setup?vpn", permission: "setup/vpn", want: false},
+		// a malformed pattern only matches itself
+		{pattern: "setup-[", permission: "setup-a", want: false},
+		{pattern: "setup-[", permission: "setup-[", want: true},
+	}
+	for _, tt := range tests {
+		if got := (GlobPermission{Pattern: tt.pattern}).Match(gorbac.NewStdPermission(tt.permission)); got != tt.want {
+			t.Errorf("'%s' matching '%s': got %t, want %t", tt.pattern, tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestNewPermission(t *testing.T) {
+	if _, ok := NewPermission("setup-*").(GlobPermission); !ok {
+		t.Error("pattern did not become a GlobPermission")
+	}
+	if _, ok := NewPermission("setup-vpn").(GlobPermission); ok {
+		t.Error("plain id became a GlobPermission")
+	}
+	if err := CheckGlob("setup-["); err == nil {
+		t.Error("malformed pattern was accepted")
+	}
+	if err := CheckGlob("setup-[ab]*"); err != nil {
+		t.Error(err)
+	}
+}
@@ -6,13 +6,19 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
-	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
 	"github.com/viktorbarzin/webhook-handler/chatbot/executor"
 	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
 	"github.com/viktorbarzin/webhook-handler/chatbot/models"
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc"
 	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -23,6 +29,8 @@ type MoveFSMResult struct {
 	CmdOutput     string
 	AdditionalMsg string
 	FSM           statemachine.FSMWithStatesAndEvents
+	// Buttons offered instead of the available transitions e.g while a prompt is pending
+	Buttons []statemachine.Event
 }
 
 const (
@@ -31,35 +39,66 @@ const (
 )
 
 var (
-	allowedUserInputRe = regexp.MustCompile(`^[a-zA-Z0-9=.@ ]{1,500}$`)
+	// Input to commands without validators is checked against these
+	defaultValidators = []validation.Rule{{Regex: `[a-zA-Z0-9=.@ ]*`, MinLength: 1, MaxLength: 500}}
 
 	// vpnFriendlyNameRegex = regexp.MustCompile(`(\w| ){1,40}`)
 	// vpnPubKeyRegex       = regexp.MustCompile(`[-A-Za-z0-9+=]{1,50}|=[^=]|={3,}`)
 )
 
-// ChatbotHandler is a HTTP handler which keeps track of conversations
+// ChatbotHandler is a HTTP handler which keeps track of conversations.
+// Messenger delivers webhooks concurrently so messages are serialized per user (see lockUser)
+// and the shared maps below are guarded by mu.
 type ChatbotHandler struct {
-	UserToFSM                 map[string]*statemachine.FSMWithStatesAndEvents
-	ConfigFile                string
-	States                    []statemachine.State
-	Events                    []statemachine.Event
-	RBACConfig                auth.RBACConfig
-	ProcessedApprovalRequests []string
+	mu sync.Mutex
+	// userLocks holds a lock per PSID so that messages from one user are processed one at a time
+	userLocks  map[string]*userLock
+	UserToFSM  map[string]*statemachine.FSMWithStatesAndEvents
+	ConfigFile string
+	States     []statemachine.State
+	Events     []statemachine.Event
+	// rbacConfig and fsmTemplate are replaced when the config is reloaded, use RBAC() and newFSM()
+	rbacConfig  auth.RBACConfig
+	fsmTemplate *statemachine.FSMWithStatesAndEvents
+	// reloadMu serializes config reloads
+	reloadMu sync.Mutex
+	// Approvals records the decisions on approval requests so each one is acted upon once
+	Approvals *ApprovalLedger
+	// Conversations persists each user's position in the FSM so it survives restarts
+	Conversations storage.ConversationStore
+	// Jobs executes commands and keeps their history
+	Jobs *jobs.Queue
+	// Grants are temporary roles issued from chat on top of the config file
+	Grants *GrantStore
+	// Identities are the Authentik accounts users have linked, see EnableAccountLinking
+	Identities *IdentityStore
+	// oidcProvider is nil unless account linking is enabled
+	oidcProvider *oidc.Provider
+	publicURL    string
+	// How long a linked account is trusted before the user has to link it again
+	linkMaxAge time.Duration
 }
 
-func NewChatbotHandler(configFile string) (*ChatbotHandler, error) {
-	rbac, err := auth.NewRBACConfig(configFile)
+func NewChatbotHandler(configFile string, store storage.Store, jobsConfig jobs.Config) (*ChatbotHandler, error) {
+	rbac, fsmTemplate, err := loadConfig(configFile)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to parse config file and create RBAC struct")
+		return nil, err
 	}
-	_, err = statemachine.ChatBotFSM(configFile)
+	jobQueue, err := jobs.NewQueue(store, jobsConfig)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create chatbot FSM from config file %s", configFile)
+		return nil, errors.Wrapf(err, "failed to create job queue")
 	}
 	c := &ChatbotHandler{
-		UserToFSM:  map[string]*statemachine.FSMWithStatesAndEvents{},
-		ConfigFile: configFile,
-		RBACConfig: rbac,
+		userLocks:     map[string]*userLock{},
+		UserToFSM:     map[string]*statemachine.FSMWithStatesAndEvents{},
+		ConfigFile:    configFile,
+		rbacConfig:    rbac,
+		fsmTemplate:   fsmTemplate,
+		Approvals:     NewApprovalLedger(store),
+		Conversations: storage.NewConversationStore(store),
+		Jobs:          jobQueue,
+		Grants:        NewGrantStore(store),
+		Identities:    NewIdentityStore(store),
 	}
 	fbapi.SetGetStartedButton()
 	return c, nil
@@ -121,7 +160,7 @@ func (c *ChatbotHandler) HandleFunc(w http.ResponseWriter, r *http.Request) {
 func (c *ChatbotHandler) processRawMessage(fbCallbackMsg models.FbMessageCallback) error {
 	for _, e := range fbCallbackMsg.Entry {
 		for _, m := range e.Messaging {
-			if err := c.processMessage(m.Sender.ID, m.Message.Text); err != nil {
+			if err := c.processMessage(m.Sender.ID, m.Message.Text, false); err != nil {
 				return errors.Wrapf(err, "failed processing raw message")
 			}
 		}
@@ -132,7 +171,7 @@ func (c *ChatbotHandler) processRawMessage(fbCallbackMsg models.FbMessageCallbac
 func (c *ChatbotHandler) processPostBackMessage(fbCallbackMsg models.FbMessagePostBackCallback) error {
 	for _, e := range fbCallbackMsg.Entry {
 		for _, m := range e.Messaging {
-			if err := c.processMessage(m.Sender.ID, m.Postback.Payload); err != nil {
+			if err := c.processMessage(m.Sender.ID, m.Postback.Payload, true); err != nil {
 				return errors.Wrapf(err, "failed processing postback message")
 			}
 		}
@@ -140,31 +179,53 @@ func (c *ChatbotHandler) processPostBackMessage(fbCallbackMsg models.FbMessagePo
 	return nil
 }
 
-func (c *ChatbotHandler) processMessage(senderID, payload string) error {
-	userFsm, ok := c.UserToFSM[senderID]
-	if !ok {
-		f, err := statemachine.ChatBotFSM(c.ConfigFile)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create chatbot FSM for user id %s", senderID)
-		}
-		c.UserToFSM[senderID] = f
-		userFsm = c.UserToFSM[senderID]
+// processMessage handles a text message or, if postback is set, a button tap from senderID
+func (c *ChatbotHandler) processMessage(senderID, payload string, postback bool) error {
+	unlock := c.lockUser(senderID)
+	defer unlock()
+
+	userFsm, err := c.loadFSM(senderID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load chatbot FSM for user id %s", senderID)
 	}
-	user := c.RBACConfig.WhoAmI(senderID)
+	user := c.RBAC().WhoAmI(senderID)
 	moveFSMResult := MoveFSMResult{}
 	moveFSMResult.FSM = *userFsm
 
-	if isApprovalRequest([]byte(payload)) {
+	if isLinkDecision(payload) {
+		return c.processLinkDecision(user, payload, moveFSMResult)
+	}
+	if isApprovalRequest(payload) {
 		glog.Infof("Processing approval request: %s", payload)
 		return c.processApprovalRequestMessage(senderID, payload, moveFSMResult)
 	}
+	conv, _, err := c.Conversations.Load(senderID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load conversation for user id %s", senderID)
+	}
+	if conv.Prompt != nil {
+		if answersPrompt(userFsm, *conv.Prompt, payload, postback) {
+			glog.Infof("Processing answer to '%s' prompt: %s", conv.Prompt.Kind, payload)
+			return c.processPromptAnswer(user, *conv.Prompt, payload, moveFSMResult)
+		}
+		glog.Infof("user %s sent '%s' instead of answering the '%s' prompt, cancelling it", senderID, payload, conv.Prompt.Kind)
+		if err := c.cancelPrompt(senderID); err != nil {
+			return errors.Wrapf(err, "failed to cancel prompt")
+		}
+	}
 	// Try make transition
-	err := c.moveFSM(user, userFsm, payload)
+	err = c.moveFSM(user, userFsm, payload)
+	pendingInput := ""
 
-	if err == nil {
+	if denied, ok := err.(*permissionDeniedError); ok {
+		glog.Warningf("%s", denied.explanation.String())
+		moveFSMResult.AdditionalMsg = denied.UserMessage()
+	} else if err == nil {
 		glog.Infof("successful transition from '%s' with msg: '%s' to '%s'. Available transitions are: %+v", userFsm.Current().Name, payload, userFsm.Current().Name, userFsm.FSM.AvailableTransitions())
+		c.enterSpecialState(user, userFsm.Current(), &moveFSMResult)
+		askFirstInput(userFsm.Current(), &moveFSMResult)
 		// Execute command at current state if allowed
-		// if c.RBACConfig.IsAllowedToExecuteMany(user, userFsm.Current().Commands) {
+		// if c.RBAC().IsAllowedToExecuteMany(user, userFsm.Current().Commands) {
 		// 	glog.Infof("user %+v is allowed to execute commands: %+v", user, userFsm.Current().Commands)
 		// 	for _, cmd := range userFsm.Current().Commands {
 		// 		executor.Execute(cmd)
@@ -176,31 +237,22 @@ func (c *ChatbotHandler) processMessage(senderID, payload string) error {
 		glog.Infof("trying to find a default handler to process '%s'", payload)
 		// This is shit, I know, will refactor
 
-		// If default handler is defined
-		if !reflect.DeepEqual(userFsm.Current().DefaultHandler, auth.Command{}) {
-			glog.Infof("found default handler")
-			// if user is allowed to execute default handler
-			if c.RBACConfig.IsAllowedToExecute(user, userFsm.Current().DefaultHandler) {
-				glog.Infof("executing default handler '%s' for user '%s' state '%s'", userFsm.Current().DefaultHandler.PrettyName, user.Name, userFsm.Current().Name)
-				// if input to handler is not valid
-				if !isValidUserInput(payload) {
-					glog.Warningf("user input '%s' did not match allowed pattern '%s'", payload, allowedUserInputRe.String())
-					moveFSMResult.AdditionalMsg = fmt.Sprintf("Invalid input. Please stick to using charates from '%s' set.", allowedUserInputRe.String())
-				} else {
-					glog.Infof("user input '%s' allowed, proceeding with executing default handler", payload)
-					moveFSMResult.CmdOutput = "Your command has been scheduled for execution, stand by for results..."
-					go executeAndRepond(senderID, moveFSMResult, userFsm.Current().DefaultHandler, payload)
-				}
+		if handler, ok := specialStateInputHandlers[userFsm.Current().SpecialStateType]; ok {
+			glog.Infof("passing '%s' to special state handler of '%s'", payload, userFsm.Current().Name)
+			output, err := handler(c, user, payload)
+			if err != nil {
+				moveFSMResult.AdditionalMsg = err.Error()
 			} else {
-				// if not allowed to execute default handler
-				glog.Warningf("found default handler '%s' to execute but user '%s' does not have permission to execute this command", userFsm.Current().DefaultHandler.PrettyName, user.Name)
-				glog.Infof("sending approval request")
-				if err := c.sendRequestApprovalRequest(user, userFsm.Current().DefaultHandler, payload); err != nil {
-					moveFSMResult.CmdOutput = fmt.Sprintf("failed to send permission approval request : %s", err.Error())
-				} else {
-					moveFSMResult.CmdOutput = fmt.Sprintf("You do not have permission to execute '%s'. I have asked for a review for your request. Please standby...", userFsm.Current().DefaultHandler.PrettyName)
-				}
+				moveFSMResult.CmdOutput = output
+			}
+		} else if len(userFsm.Current().Inputs) > 0 {
+			glog.Infof("passing '%s' to the inputs of state '%s'", payload, userFsm.Current().Name)
+			if pendingInput, err = c.collectInput(user, userFsm.Current(), payload, &moveFSMResult); err != nil {
+				glog.Errorf("failed to collect input from user %s: %s", senderID, err.Error())
+				moveFSMResult.AdditionalMsg = "Failed to save your answer, please try again"
 			}
+		} else if !reflect.DeepEqual(userFsm.Current().DefaultHandler, auth.Command{}) {
+			pendingInput = c.runDefaultHandler(user, userFsm.Current(), payload, nil, false, &moveFSMResult)
 		} else {
 			// not a valid event, no defined handler
 			glog.Warningf("failed to make transition from '%s' with msg '%s'. Available transitions are: %+v", userFsm.Current().Name, payload, userFsm.FSM.AvailableTransitions())
@@ -208,16 +260,31 @@ func (c *ChatbotHandler) processMessage(senderID, payload string) error {
 		}
 	}
 
+	if err := c.saveFSM(senderID, userFsm, pendingInput); err != nil {
+		glog.Errorf("failed to persist conversation for user %s: %s", senderID, err.Error())
+	}
 	return respondToUser(senderID, moveFSMResult)
 }
 
 func (c *ChatbotHandler) processApprovalRequestMessage(senderID, payload string, moveFSMResult MoveFSMResult) error {
-	user := c.RBACConfig.WhoAmI(senderID)
+	user := c.RBAC().WhoAmI(senderID)
 
-	req, _ := DeserializeApprovalRequest([]byte(payload))
-	if c.isProcessed(req.ID) {
-		cmd, _ := c.cmdFromId(req.CmdID)
-		fbapi.SendRawMessage(senderID, fmt.Sprintf("approval request for '%s' has already been processed", cmd.PrettyName))
+	token, err := parseApprovalToken(payload)
+	if err != nil {
+		glog.Warningf("user %s sent an invalid approval token '%s': %s", senderID, payload, err.Error())
+		fbapi.SendRawMessage(senderID, "Invalid approval request")
+		return nil
+	}
+	if token.State != ApprovalStateAccepted && token.State != ApprovalStateRejected {
+		fbapi.SendRawMessage(senderID, fmt.Sprintf("invalid decision '%s' for approval request", token.State.String()))
+		return fmt.Errorf("unknown approval state %d for request %s", token.State, token.RequestID)
+	}
+	req, found, err := c.Approvals.Request(token.RequestID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load approval request")
+	}
+	if !found {
+		fbapi.SendRawMessage(senderID, "This approval request no longer exists")
 		return nil
 	}
 	what, err := c.cmdFromId(req.CmdID)
@@ -225,14 +292,48 @@ func (c *ChatbotHandler) processApprovalRequestMessage(senderID, payload string,
 		fbapi.SendRawMessage(senderID, fmt.Sprintf("failed to find command with id '%s'", req.CmdID))
 		return err
 	}
+	askForReason := false
 	// if sender is authorized to process this request
-	if c.RBACConfig.UserHasRole(user, what.ApprovedBy) {
+	if c.approversRBAC(what).UserHasRole(user, what.ApprovedBy) {
 		// user authorized
-		c.SendApprovalRequestUpdateNotification(req, user)
-		if req.State == ApprovalStateAccepted {
-			fbapi.SendRawMessage(req.From.ID, fmt.Sprintf("Command '%s' with input '%s' will begin executing shortly...", what.PrettyName, req.Payload))
-
-			go executeAndRepond(req.From.ID, moveFSMResult, what, req.Payload)
+		tally, err := c.Approvals.Vote(req.ID, token.State, user, what)
+		switch errors.Cause(err) {
+		case nil:
+		case ErrApprovalClosed:
+			decision := tally.Decision
+			fbapi.SendRawMessage(senderID, fmt.Sprintf("Approval request for '%s' has already been %s by %s on %s", what.PrettyName, decision.State.String(), decision.DecidedBy.Name, decision.DecidedAt.Format(time.RFC1123)))
+			return nil
+		case ErrAlreadyVoted:
+			fbapi.SendRawMessage(senderID, fmt.Sprintf("You have already approved '%s'. %s", what.PrettyName, tally.String()))
+			return nil
+		case ErrSameGroupVote:
+			fbapi.SendRawMessage(senderID, fmt.Sprintf("Someone from your group has already approved '%s', the remaining approvals must come from other groups. %s", what.PrettyName, tally.String()))
+			return nil
+		default:
+			fbapi.SendRawMessage(senderID, fmt.Sprintf("failed to record your decision on '%s', please try again", what.PrettyName))
+			return errors.Wrapf(err, "failed to record approval decision")
+		}
+		if tally.Required > 1 && token.State == ApprovalStateAccepted {
+			c.notifyApproversOfTally(req, what, user, token.State, tally)
+		}
+		if tally.Decision == nil {
+			// waiting for more approvals
+			return nil
+		}
+		c.SendApprovalRequestUpdateNotification(req, token.State, user)
+		if role, ok := req.RequestedRole(); ok && token.State == ApprovalStateAccepted {
+			if err := c.grantRequestedRole(req, role, user); err != nil {
+				glog.Errorf("failed to grant requested role: %s", err.Error())
+				fbapi.SendRawMessage(senderID, fmt.Sprintf("Failed to give %s the '%s' role: %s", req.From.Name, role, err.Error()))
+			}
+		} else if token.State == ApprovalStateAccepted {
+			job, err := c.executeAndRepond(req.From, &user, moveFSMResult, what, req.Payload, req.Fields)
+			if err != nil {
+				fbapi.SendRawMessage(req.From.ID, fmt.Sprintf("Failed to schedule command '%s': %s", what.PrettyName, err.Error()))
+				fbapi.SendRawMessage(senderID, fmt.Sprintf("Failed to schedule command '%s': %s", what.PrettyName, err.Error()))
+			} else {
+				fbapi.SendRawMessage(req.From.ID, fmt.Sprintf("Command '%s' with input '%s' will begin executing shortly as job %s...", what.PrettyName, req.Payload, job.ID))
+			}
 			// output, err := executor.Execute(what, req.Payload)
 			// moveFSMResult.CmdOutput = output
 			// if err != nil {
@@ -240,10 +341,9 @@ func (c *ChatbotHandler) processApprovalRequestMessage(senderID, payload string,
 			// } else {
 			// 	moveFSMResult.AdditionalMsg = "Success!"
 			// }
-		} else if req.State == ApprovalStateRejected {
-
-		} else {
-			// unknown approval state request
+		} else if token.State == ApprovalStateRejected {
+			c.notifyOtherApprovers(req, what, user, fmt.Sprintf("%s rejected the request of '%s'(ID: %s) to %s. The request is now closed.", user.Name, req.From.Name, req.From.ID, req.Summary(what)))
+			askForReason = true
 		}
 	} else {
 		// user not allowed to authrozie this request
@@ -256,25 +356,144 @@ func (c *ChatbotHandler) processApprovalRequestMessage(senderID, payload string,
 	if err := respondToUser(senderID, moveFSMResult); err != nil {
 		return errors.Wrapf(err, "failed to notify request moderator about the outcome of the command")
 	}
+	if askForReason {
+		if err := c.askPrompt(senderID, storage.Prompt{Kind: promptRejectionReason, Ref: req.ID}, fmt.Sprintf("Why did you reject '%s'? Your answer will be sent to %s.", what.PrettyName, req.From.Name)); err != nil {
+			return errors.Wrapf(err, "failed to ask moderator for rejection reason")
+		}
+	}
 	return nil
 }
 
-func (c *ChatbotHandler) resetFSM(userFsm map[string]*statemachine.FSMWithStatesAndEvents, userid string) {
-	f, _ := statemachine.ChatBotFSM(c.ConfigFile)
-	userFsm[userid] = f
+// runDefaultHandler runs the default handler of state with input if the user is allowed to, otherwise asks for approval.
+// fields are the answers to the state's inputs, which replace the command's validators.
+// Commands with confirm set ask the user to confirm their input first unless confirmed is true.
+// Returns the input which is pending confirmation or approval, if any.
+func (c *ChatbotHandler) runDefaultHandler(user auth.User, state statemachine.State, input string, fields map[string]string, confirmed bool, moveFSMResult *MoveFSMResult) string {
+	glog.Infof("found default handler")
+	// states with inputs have validated each field already
+	if len(state.Inputs) == 0 {
+		if err := validateCommandInput(state.DefaultHandler, input); err != nil {
+			glog.Warningf("user input '%s' for '%s' is invalid: %s", input, state.DefaultHandler.PrettyName, err.Error())
+			moveFSMResult.AdditionalMsg = fmt.Sprintf("Invalid input: %s. Please try again.", err.Error())
+			return ""
+		}
+	}
+	if state.DefaultHandler.Confirm && !confirmed {
+		if err := c.askToConfirmInput(user, state, input, fields, moveFSMResult); err != nil {
+			glog.Errorf("failed to ask user %s to confirm input: %s", user.ID, err.Error())
+			moveFSMResult.AdditionalMsg = "Failed to save your input, please try again"
+			return ""
+		}
+		return input
+	}
+	// if user is not allowed to execute default handler
+	if !c.RBAC().IsAllowedToExecute(user, state.DefaultHandler) {
+		glog.Warningf("found default handler '%s' to execute but user '%s' does not have permission to execute this command", state.DefaultHandler.PrettyName, user.Name)
+		glog.Infof("sending approval request")
+		if err := c.sendRequestApprovalRequest(user, state.DefaultHandler, input, fields); err != nil {
+			moveFSMResult.CmdOutput = fmt.Sprintf("failed to send permission approval request : %s", err.Error())
+			return ""
+		}
+		moveFSMResult.CmdOutput = fmt.Sprintf("You do not have permission to execute '%s'. I have asked for a review for your request. Please standby...", state.DefaultHandler.PrettyName)
+		return input
+	}
+	glog.Infof("executing default handler '%s' for user '%s' state '%s'", state.DefaultHandler.PrettyName, user.Name, state.Name)
+	glog.Infof("user input '%s' allowed, proceeding with executing default handler", input)
+	job, err := c.executeAndRepond(user, nil, *moveFSMResult, state.DefaultHandler, input, fields)
+	if err != nil {
+		moveFSMResult.CmdOutput = fmt.Sprintf("Failed to schedule your command: %s", err.Error())
+	} else {
+		moveFSMResult.CmdOutput = fmt.Sprintf("Your command has been scheduled for execution as job %s, stand by for results...", job.ID)
+	}
+	return ""
+}
+
+// loadFSM returns the user's FSM, restoring their last saved state if they are not in memory yet
+func (c *ChatbotHandler) loadFSM(userid string) (*statemachine.FSMWithStatesAndEvents, error) {
+	c.mu.Lock()
+	f, ok := c.UserToFSM[userid]
+	c.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+	f = c.newFSM()
+	conv, found, err := c.Conversations.Load(userid)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if f.HasState(conv.State) {
+			glog.Infof("restoring user %s to state '%s' (last seen %s)", userid, conv.State, conv.LastSeen)
+			f.FSM.SetState(conv.State)
+		} else {
+			glog.Warningf("saved state '%s' for user %s no longer exists, starting from initial state", conv.State, userid)
+		}
+	}
+	c.mu.Lock()
+	c.UserToFSM[userid] = f
+	c.mu.Unlock()
+	return f, nil
+}
+
+func (c *ChatbotHandler) saveFSM(userid string, f *statemachine.FSMWithStatesAndEvents, pendingInput string) error {
+	conv, _, err := c.Conversations.Load(userid)
+	if err != nil {
+		return err
+	}
+	if conv.State != f.FSM.Current() {
+		// answers to inputs belong to the state they were given in
+		conv.Fields = nil
+	}
+	conv.State = f.FSM.Current()
+	conv.LastSeen = time.Now()
+	conv.PendingInput = pendingInput
+	return c.Conversations.Save(userid, conv)
+}
+
+func (c *ChatbotHandler) resetFSM(userid string) error {
+	f := c.newFSM()
+	c.mu.Lock()
+	c.UserToFSM[userid] = f
+	c.mu.Unlock()
+	return c.saveFSM(userid, f, "")
+}
+
+// userLock serializes the messages of one user. It is removed from userLocks once nobody holds or waits for it
+type userLock struct {
+	mu sync.Mutex
+	// Number of lockUser calls holding or waiting for mu, guarded by ChatbotHandler.mu
+	refs int
 }
 
-func (c *ChatbotHandler) isProcessed(requestGuid string) bool {
-	for _, p := range c.ProcessedApprovalRequests {
-		if p == requestGuid {
-			return true
+// lockUser blocks until no other message from userid is being processed and returns the unlock func
+func (c *ChatbotHandler) lockUser(userid string) func() {
+	c.mu.Lock()
+	l, ok := c.userLocks[userid]
+	if !ok {
+		l = &userLock{}
+		c.userLocks[userid] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(c.userLocks, userid)
 		}
 	}
-	return false
 }
 
-func isValidUserInput(input string) bool {
-	return allowedUserInputRe.Match([]byte(input))
+// validateCommandInput checks input against the command's validators or the default ones if it has none
+func validateCommandInput(cmd auth.Command, input string) error {
+	rules := cmd.Validators
+	if len(rules) == 0 {
+		rules = defaultValidators
+	}
+	return validation.ValidateRules(rules, input)
 }
 
 func respondToUser(recipient string, moveFSMResult MoveFSMResult) error {
@@ -300,6 +519,9 @@ func respondToUser(recipient string, moveFSMResult MoveFSMResult) error {
 
 	// Create postback with options to choose from next
 	events := statemachine.Sorted(moveFSMResult.FSM.AvailableTransitions())
+	if len(moveFSMResult.Buttons) > 0 {
+		events = moveFSMResult.Buttons
+	}
 	buttons := eventsToPostbackButtons(events)
 	elements := getPostbackElements("What's next?", "Tap to answer", buttons)
 	// Get consistent button order
@@ -309,7 +531,7 @@ func respondToUser(recipient string, moveFSMResult MoveFSMResult) error {
 }
 
 // Given a user state machine and a message, try to make a transition and create a response
-func (h ChatbotHandler) moveFSM(user auth.User, userFsm *statemachine.FSMWithStatesAndEvents, event string) error {
+func (h *ChatbotHandler) moveFSM(user auth.User, userFsm *statemachine.FSMWithStatesAndEvents, event string) error {
 	// If transition is allowed in state machine
 	if userFsm.FSM.Can(event) {
 		// move to state and check permission. if not allowed, revert
@@ -319,9 +541,13 @@ func (h ChatbotHandler) moveFSM(user auth.User, userFsm *statemachine.FSMWithSta
 			return errors.Wrapf(err, "failed to move")
 		}
 		// If user is not allowed to be in new state, revert
-		if !h.RBACConfig.IsAllowedMany(user, auth.ToPermissions(userFsm.Current().Permissions)) {
+		state := userFsm.Current()
+		if !h.RBAC().IsAllowedMany(user, auth.ToPermissions(state.Permissions)) {
 			userFsm.FSM.SetState(oldState)
-			return fmt.Errorf("user %+v does not have permission for state %+v. returning to %s", user, userFsm.FSM.Current(), oldState)
+			return &permissionDeniedError{
+				state:       state.Name,
+				explanation: h.RBAC().Explain(user, fmt.Sprintf("enter state '%s'", state.Name), auth.ToPermissions(state.Permissions)),
+			}
 		}
 		return nil
 	}
@@ -340,6 +566,21 @@ func (h ChatbotHandler) moveFSM(user auth.User, userFsm *statemachine.FSMWithSta
 	// }
 }
 
+// permissionDeniedError is returned by moveFSM when the user lacks a permission of the destination state
+type permissionDeniedError struct {
+	state       string
+	explanation auth.Explanation
+}
+
+func (e *permissionDeniedError) Error() string {
+	return e.explanation.String()
+}
+
+// UserMessage tells the user what they are missing without revealing how other users got it
+func (e *permissionDeniedError) UserMessage() string {
+	return fmt.Sprintf("Sorry, you are not allowed to go to '%s'. You need the permission %s. Ask an admin if you think you should have it.", e.state, strings.Join(e.explanation.Missing(), " and "))
+}
+
 func getPostbackElements(title, subtitle string, buttons []models.MessageWithPostbackButton) []models.MessageWithPostbackElement {
 	// Fb allows only 3 buttons per element, so group elements
 	elements := []models.MessageWithPostbackElement{}
@@ -447,20 +688,52 @@ func getMessageType(jsonBody string) (MessageType, error) {
 	return 0, errors.New(fmt.Sprintf("message type is not supported. message: %s", jsonBody))
 }
 
-func executeAndRepond(senderID string, moveFSMResult MoveFSMResult, cmd auth.Command, payload string) {
-	cmdOutput, err := executor.Execute(cmd, payload)
-	// if no error during execution of handler
-	if err == nil {
-		glog.Infof("successfully executed default handler for input '%s'", payload)
-		if cmd.ShowCmdOutput {
-			moveFSMResult.CmdOutput = cmdOutput
+// executeAndRepond queues cmd as a job and sends the result to the requester once it has finished
+func (c *ChatbotHandler) executeAndRepond(requester auth.User, approver *auth.User, moveFSMResult MoveFSMResult, cmd auth.Command, payload string, fields map[string]string) (jobs.Job, error) {
+	var progress *progressReporter
+	var onLine func(string)
+	if cmd.StreamOutput {
+		progress = newProgressReporter(requester.ID)
+		onLine = progress.Add
+	}
+	job, err := c.Jobs.Submit(cmd, payload, fields, requester, approver, onLine, func(job jobs.Job, cmdOutput string, err error) {
+		if progress != nil {
+			lines, skipped := progress.Close()
+			// the output has already been sent, do not repeat it
+			cmdOutput = fmt.Sprintf("'%s' ran for %s and produced %d lines of output.\n", cmd.PrettyName, job.EndedAt.Sub(job.StartedAt).Round(time.Second), lines)
+			if skipped > 0 {
+				cmdOutput += fmt.Sprintf("%d lines were skipped to avoid flooding the chat, see the job's output for all of them.\n", skipped)
+			}
 		}
-		moveFSMResult.AdditionalMsg = cmd.SuccessExplanation
-	} else {
-		// if error during execution of handler
-		errMsg := fmt.Sprintf("failed to execute handler func: %s", err.Error())
-		glog.Errorf(errMsg)
-		moveFSMResult.AdditionalMsg = errMsg
-	}
-	respondToUser(senderID, moveFSMResult)
+		// if no error during execution of handler
+		if err == nil {
+			glog.Infof("successfully executed default handler for input '%s'", payload)
+			if cmd.ShowCmdOutput || cmd.StreamOutput {
+				moveFSMResult.CmdOutput = cmdOutput
+			}
+			moveFSMResult.AdditionalMsg = cmd.SuccessExplanation
+		} else if timeoutErr, ok := err.(*executor.TimeoutError); ok {
+			glog.Errorf("command '%s' with input '%s' %s", cmd.PrettyName, payload, timeoutErr.Error())
+			moveFSMResult.CmdOutput = ""
+			if cmd.ShowCmdOutput && !cmd.StreamOutput && cmdOutput != "" {
+				moveFSMResult.CmdOutput = fmt.Sprintf("Output so far:\n%s\n\n", cmdOutput)
+			}
+			moveFSMResult.AdditionalMsg = fmt.Sprintf("'%s' %s and was stopped. Please try again later or contact an admin.", cmd.PrettyName, timeoutErr.Error())
+		} else {
+			// if error during execution of handler
+			errMsg := fmt.Sprintf("failed to execute handler func: %s", err.Error())
+			glog.Errorf(errMsg)
+			moveFSMResult.AdditionalMsg = errMsg
+		}
+		moveFSMResult.AdditionalMsg += fmt.Sprintf("\n(job %s)", job.ID)
+		// do not interleave the result with a message the user is currently sending
+		unlock := c.lockUser(requester.ID)
+		defer unlock()
+		respondToUser(requester.ID, moveFSMResult)
+	})
+	if err != nil && progress != nil {
+		// done is only called for accepted jobs
+		progress.Close()
+	}
+	return job, err
 }
@@ -0,0 +1,296 @@
+package chatbot
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
+)
+
+const testConfigFile = "config/viktorwebservices.yaml"
+
+// sentMessage is a message the bot sent through the Send API
+type sentMessage struct {
+	Recipient string
+	// Text of raw messages, empty for button templates
+	Text    string
+	Buttons bool
+}
+
+// fakeSendAPI records what fbapi sends instead of calling graph.facebook.com
+type fakeSendAPI struct {
+	mu   sync.Mutex
+	sent []sentMessage
+}
+
+func (f *fakeSendAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var payload struct {
+		Recipient struct {
+			ID string `json:"id"`
+		} `json:"recipient"`
+		Message struct {
+			Text       string          `json:"text"`
+			Attachment json.RawMessage `json:"attachment"`
+		} `json:"message"`
+	}
+	json.Unmarshal(body, &payload)
+	if payload.Recipient.ID != "" {
+		f.mu.Lock()
+		f.sent = append(f.sent, sentMessage{Recipient: payload.Recipient.ID, Text: payload.Message.Text, Buttons: len(payload.Message.Attachment) > 0})
+		f.mu.Unlock()
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Body: ioutil.NopCloser(strings.NewReader("{}")), Header: http.Header{}, Request: r}, nil
+}
+
+// to returns the messages sent to recipient in the order they were sent
+func (f *fakeSendAPI) to(recipient string) []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := []sentMessage{}
+	for _, m := range f.sent {
+		if m.Recipient == recipient {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// stubSendAPI routes fbapi's requests to a fakeSendAPI until the test ends
+func stubSendAPI(t *testing.T) *fakeSendAPI {
+	f := &fakeSendAPI{}
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = f
+	t.Cleanup(func() { http.DefaultClient.Transport = old })
+	return f
+}
+
+func newTestHandler(t *testing.T) *ChatbotHandler {
+	store, err := storage.NewFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChatbotHandler(testConfigFile, store, jobs.Config{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// postMessage delivers a signed webhook with a text message from sender to c
+func postMessage(t *testing.T, c *ChatbotHandler, sender, text string) {
+	postWebhook(t, c, fmt.Sprintf(`{"object":"page","entry":[{"id":"1","time":1,"messaging":[{"sender":{"id":%q},"recipient":{"id":"page"},"timestamp":1,"message":{"mid":"m","text":%q}}]}]}`, sender, text))
+}
+
+// postPostback delivers a signed webhook with a button tap from sender to c
+func postPostback(t *testing.T, c *ChatbotHandler, sender, payload string) {
+	postWebhook(t, c, fmt.Sprintf(`{"object":"page","entry":[{"id":"1","time":1,"messaging":[{"sender":{"id":%q},"recipient":{"id":"page"},"timestamp":1,"postback":{"title":"button","payload":%q}}]}]}`, sender, payload))
+}
+
+func postWebhook(t *testing.T, c *ChatbotHandler, body string) {
+	mac := hmac.New(sha1.New, []byte(fbapi.AppSecret))
+	mac.Write([]byte(body))
+	r := httptest.NewRequest(http.MethodPost, fbapi.HandlerPath, strings.NewReader(body))
+	r.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	c.HandleFunc(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("webhook %s: got %d %s", body, w.Code, w.Body.String())
+	}
+}
+
+// Messages from different users are processed in parallel, each user's replies come in the order of their messages
+func TestParallelSenders(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+
+	const users, rounds = 8, 10
+	messages := []string{"GetStarted"}
+	for i := 0; i < rounds; i++ {
+		messages = append(messages, "GetInfo", "Back")
+	}
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(sender string) {
+			defer wg.Done()
+			for _, m := range messages {
+				postMessage(t, c, sender, m)
+			}
+		}(fmt.Sprintf("psid-%d", u))
+	}
+	wg.Wait()
+
+	for u := 0; u < users; u++ {
+		sender := fmt.Sprintf("psid-%d", u)
+		want := []string{"How can I help?"}
+		for i := 0; i < rounds; i++ {
+			want = append(want, "Get more information about my services.", "How can I help?")
+		}
+		got := []string{}
+		for _, m := range sendAPI.to(sender) {
+			if !m.Buttons {
+				got = append(got, m.Text)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("replies to %s:\ngot  %q\nwant %q", sender, got, want)
+		}
+	}
+	assertNoUserLocks(t, c)
+}
+
+// Concurrent messages from one user are processed one at a time: each reply is followed by its buttons
+func TestParallelMessagesFromOneSender(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+
+	const sender, senders, perSender = "psid-1", 8, 10
+	postMessage(t, c, sender, "GetStarted")
+	postMessage(t, c, sender, "GetInfo")
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				// not a transition out of Info, so every reply ends with the Info message
+				postMessage(t, c, sender, "Help")
+			}
+		}()
+	}
+	wg.Wait()
+
+	sent := sendAPI.to(sender)
+	if len(sent) != 2*(2+senders*perSender) {
+		t.Fatalf("got %d messages, want %d", len(sent), 2*(2+senders*perSender))
+	}
+	for i, m := range sent {
+		if m.Buttons != (i%2 == 1) {
+			t.Fatalf("message %d: replies to different messages are interleaved", i)
+		}
+		if i >= 4 && !m.Buttons && !strings.HasSuffix(m.Text, "Get more information about my services.") {
+			t.Errorf("message %d: got %q", i, m.Text)
+		}
+	}
+	if f, err := c.loadFSM(sender); err != nil || f.Current().Name != "Info" {
+		t.Errorf("user ended in the wrong state: %v", err)
+	}
+	assertNoUserLocks(t, c)
+}
+
+// assertNoUserLocks checks that the locks of users who have no message in flight were removed
+func assertNoUserLocks(t *testing.T, c *ChatbotHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.userLocks) != 0 {
+		t.Errorf("%d user locks left after all messages were processed", len(c.userLocks))
+	}
+}
+
+// A restarted chatbot continues each conversation from the state it was saved in
+func TestConversationRestoredAfterRestart(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	newHandler := func() *ChatbotHandler {
+		store, err := storage.NewFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewChatbotHandler(testConfigFile, store, jobs.Config{Workers: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	const sender = "psid-restart"
+	c := newHandler()
+	postMessage(t, c, sender, "GetStarted")
+	postMessage(t, c, sender, "GetInfo")
+
+	restarted := newHandler()
+	if f, err := restarted.loadFSM(sender); err != nil || f.Current().Name != "Info" {
+		t.Fatalf("state was not restored: %v", err)
+	}
+	// Back is only a transition out of Info
+	postMessage(t, restarted, sender, "Back")
+	sent := sendAPI.to(sender)
+	if last := sent[len(sent)-2]; last.Text != "How can I help?" {
+		t.Fatalf("got %q after restart", last.Text)
+	}
+}
+
+func TestCommandValidatorsAreSkippedForStatesWithInputs(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	// the validators would reject the fields joined as input
+	cmd := auth.Command{ID: "cmd", PrettyName: "Cmd", Confirm: true, Validators: []validation.Rule{{Regex: "[0-9]+"}}}
+	tests := []struct {
+		name      string
+		inputs    []validation.Field
+		wantValid bool
+	}{
+		{name: "command validators", wantValid: false},
+		{name: "state inputs", inputs: []validation.Field{{Name: "dns", Rule: validation.Rule{Type: validation.TypeIP}}}, wantValid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := statemachine.State{Name: "Setup", DefaultHandler: cmd, Inputs: tt.inputs}
+			var res MoveFSMResult
+			pending := c.runDefaultHandler(c.RBAC().WhoAmI("psid-user"), state, "1.1.1.1", map[string]string{"dns": "1.1.1.1"}, false, &res)
+			if valid := !strings.Contains(res.AdditionalMsg, "Invalid input"); valid != tt.wantValid {
+				t.Fatalf("got %+v, want valid %t", res, tt.wantValid)
+			}
+			if tt.wantValid && pending != "1.1.1.1" {
+				t.Fatalf("input is not pending confirmation: %+v", res)
+			}
+		})
+	}
+}
+
+func TestWireguardConfigNameValidation(t *testing.T) {
+	c := newTestHandler(t)
+	cmd, err := c.cmdFromId("setup_wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input     string
+		wantValid bool
+	}{
+		{input: "laptop", wantValid: true},
+		{input: "my_phone-2", wantValid: true},
+		{input: "", wantValid: false},
+		{input: "x -use-case foo", wantValid: false},
+		{input: "-use-case", wantValid: false},
+		{input: "laptop;reboot", wantValid: false},
+		{input: strings.Repeat("a", 41), wantValid: false},
+	}
+	for _, tt := range tests {
+		if err := validateCommandInput(cmd, tt.input); (err == nil) != tt.wantValid {
+			t.Errorf("input %q: got %v, want valid %t", tt.input, err, tt.wantValid)
+		}
+	}
+}
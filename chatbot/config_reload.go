@@ -0,0 +1,138 @@
+package chatbot
+
+import (
+	"os"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/configcheck"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// loadConfig parses both the RBAC and the state machine parts of configFile.
+// Only configs which cannot be parsed are refused, problems found by the validate command are logged
+func loadConfig(configFile string) (auth.RBACConfig, *statemachine.FSMWithStatesAndEvents, error) {
+	if problems, err := configcheck.Check(configFile); err == nil {
+		for _, p := range problems {
+			glog.Warningf("%s:%s", configFile, p.String())
+		}
+	}
+	rbac, err := auth.NewRBACConfig(configFile)
+	if err != nil {
+		return auth.RBACConfig{}, nil, errors.Wrapf(err, "failed to parse config file and create RBAC struct")
+	}
+	fsmTemplate, err := statemachine.ChatBotFSM(configFile)
+	if err != nil {
+		return auth.RBACConfig{}, nil, errors.Wrapf(err, "failed to create chatbot FSM from config file %s", configFile)
+	}
+	return rbac, fsmTemplate, nil
+}
+
+// RBAC returns the current RBAC config along with the grants issued from chat
+func (c *ChatbotHandler) RBAC() auth.RBACConfig {
+	c.mu.Lock()
+	rbac := c.rbacConfig
+	c.mu.Unlock()
+	if c.Grants != nil {
+		grants, err := c.Grants.All()
+		if err != nil {
+			glog.Errorf("failed to load grants, ignoring them: %s", err.Error())
+		}
+		rbac.Grants = grants
+	}
+	if c.Identities != nil {
+		identities, err := c.Identities.All()
+		if err != nil {
+			glog.Errorf("failed to load linked accounts, ignoring them: %s", err.Error())
+		}
+		rbac.Identities = identities
+	}
+	return rbac
+}
+
+// newFSM returns a state machine in the initial state built from the current config
+func (c *ChatbotHandler) newFSM() *statemachine.FSMWithStatesAndEvents {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fsmTemplate.Clone()
+}
+
+// Reload re-reads the config file and swaps it in if it is valid. Otherwise the current config is kept.
+// Users in memory are moved to the same state of the new state machine, or to the initial state if theirs no longer exists.
+func (c *ChatbotHandler) Reload() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	rbac, fsmTemplate, err := loadConfig(c.ConfigFile)
+	if err != nil {
+		return errors.Wrapf(err, "not reloading invalid config")
+	}
+	c.mu.Lock()
+	c.rbacConfig = rbac
+	c.fsmTemplate = fsmTemplate
+	users := make([]string, 0, len(c.UserToFSM))
+	for id := range c.UserToFSM {
+		users = append(users, id)
+	}
+	c.mu.Unlock()
+
+	for _, id := range users {
+		if err := c.migrateFSM(id); err != nil {
+			glog.Errorf("failed to migrate user %s to the new config: %s", id, err.Error())
+		}
+	}
+	glog.Infof("reloaded config from %s, migrated %d users", c.ConfigFile, len(users))
+	return nil
+}
+
+// migrateFSM replaces the user's state machine with one built from the current config
+func (c *ChatbotHandler) migrateFSM(userid string) error {
+	// wait for the message being processed, if any, so that its transition is not lost
+	unlock := c.lockUser(userid)
+	defer unlock()
+
+	f := c.newFSM()
+	c.mu.Lock()
+	old := c.UserToFSM[userid]
+	c.UserToFSM[userid] = f
+	c.mu.Unlock()
+
+	state := old.FSM.Current()
+	if f.HasState(state) {
+		f.FSM.SetState(state)
+		return nil
+	}
+	glog.Warningf("state '%s' of user %s no longer exists, moving them to '%s'", state, userid, statemachine.InitialState)
+	return c.saveFSM(userid, f, "")
+}
+
+// WatchConfig reloads the config every time the config file changes. The file is checked every interval
+func (c *ChatbotHandler) WatchConfig(interval time.Duration) {
+	last, err := os.Stat(c.ConfigFile)
+	if err != nil {
+		glog.Errorf("failed to stat config file %s, not watching it: %s", c.ConfigFile, err.Error())
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(c.ConfigFile)
+			if err != nil {
+				glog.Warningf("failed to stat config file %s: %s", c.ConfigFile, err.Error())
+				continue
+			}
+			if info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			glog.Infof("config file %s changed, reloading", c.ConfigFile)
+			if err := c.Reload(); err != nil {
+				glog.Errorf("failed to reload config: %s", err.Error())
+			}
+		}
+	}()
+}
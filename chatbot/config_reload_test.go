@@ -0,0 +1,137 @@
+package chatbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+)
+
+// newReloadableHandler returns a handler using a copy of the shipped config and a function replacing old with new in it
+func newReloadableHandler(t *testing.T) (*ChatbotHandler, func(old, new string)) {
+	shipped, err := ioutil.ReadFile(testConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "chatbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, shipped, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChatbotHandler(path, store, jobs.Config{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(old, new string) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), old) {
+			t.Fatalf("config does not contain %q", old)
+		}
+		if err := ioutil.WriteFile(path, []byte(strings.Replace(string(content), old, new, 1)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, edit
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{name: "invalid yaml", old: "states:", new: "states: ["},
+		{name: "invalid validator", old: `regex: "[a-zA-Z0-9_][a-zA-Z0-9_-]*"`, new: `regex: "[a-z"`},
+		{name: "undefined alias", old: "defaultHandler: *cmd-setup-email-alias", new: "defaultHandler: *cmd-missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendAPI := stubSendAPI(t)
+			c, edit := newReloadableHandler(t)
+			const sender = "psid-reload"
+			postMessage(t, c, sender, "GetStarted")
+			postMessage(t, c, sender, "GetInfo")
+
+			edit(tt.old, tt.new)
+			if err := c.Reload(); err == nil {
+				t.Fatal("reloaded an invalid config")
+			}
+
+			if _, err := c.cmdFromId("setup_wireguard"); err != nil {
+				t.Fatalf("old commands are gone: %v", err)
+			}
+			postMessage(t, c, sender, "Back")
+			sent := sendAPI.to(sender)
+			if last := sent[len(sent)-2]; last.Text != "How can I help?" {
+				t.Fatalf("got %q after a failed reload", last.Text)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsConversations(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c, edit := newReloadableHandler(t)
+	const atHello, atInfo, confirming = "psid-hello", "psid-info", "psid-confirming"
+	postMessage(t, c, atHello, "GetStarted")
+	postMessage(t, c, atInfo, "GetStarted")
+	postMessage(t, c, atInfo, "GetInfo")
+	enterEmailAlias(t, c, confirming, "me@example.com")
+
+	edit(`"How can I help?"`, `"How can I help you?"`)
+	edit(`id: &state-info "Info"`, `id: &state-info "About"`)
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// states which still exist are kept and use the new config
+	if f, _ := c.loadFSM(atHello); f.Current().Name != "Hello" {
+		t.Fatalf("user at Hello was moved to '%s'", f.Current().Name)
+	}
+	postMessage(t, c, atHello, "GetInfo")
+	if f, _ := c.loadFSM(atHello); f.Current().Name != "About" {
+		t.Fatalf("got to '%s' with the new config", f.Current().Name)
+	}
+	// users in removed states start over
+	if f, _ := c.loadFSM(atInfo); f.Current().Name != "Initial" {
+		t.Fatalf("user in a removed state is in '%s'", f.Current().Name)
+	}
+	postMessage(t, c, atInfo, "GetStarted")
+	sent := sendAPI.to(atInfo)
+	if last := sent[len(sent)-2]; last.Text != "How can I help you?" {
+		t.Fatalf("got %q after the reload", last.Text)
+	}
+	// input pending confirmation can still be confirmed
+	postPostback(t, c, confirming, confirmInputPayload)
+	pending, err := c.Approvals.Pending()
+	if err != nil || len(pending) != 1 || pending[0].Fields["forward_to"] != "me@example.com" {
+		t.Fatalf("confirmed input got lost in the reload: %+v %v", pending, err)
+	}
+}
+
+// Problems reported by the validate command do not stop a config the chatbot can load
+func TestReloadAcceptsConfigWithCheckProblems(t *testing.T) {
+	stubSendAPI(t)
+	c, edit := newReloadableHandler(t)
+	edit("- id: &state-hello \"Hello\"", "- id: \"Unreachable\"\n  message: \"Nobody gets here\"\n- id: &state-hello \"Hello\"")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.newFSM(); !f.HasState("Unreachable") {
+		t.Fatal("config was not reloaded")
+	}
+}
@@ -0,0 +1,444 @@
+// Package configcheck finds mistakes in the chatbot config file which would otherwise only show up at runtime
+package configcheck
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+
+	// Event sent by the "Get Started" button
+	getStartedEvent = "GetStarted"
+)
+
+// Problem is a single mistake in the config file. Line is 0 if the position is unknown
+type Problem struct {
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, p.Severity, p.Message)
+}
+
+// HasErrors returns true if any of problems is an error
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// item is an entry of one of the top level lists along with where its id is defined
+type item struct {
+	id   string
+	node *yaml.Node
+	pos  *yaml.Node
+}
+
+type checker struct {
+	problems []Problem
+	// top level keys of all documents e.g "states" -> list node
+	sections map[string]*yaml.Node
+	// entries of each section, so duplicates are reported once
+	cache map[string][]item
+}
+
+// Check loads configFile the same way the chatbot does and checks references between its parts.
+// The returned error is only set if the file cannot be read.
+func Check(configFile string) ([]Problem, error) {
+	fileBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file %s", configFile)
+	}
+	c := &checker{sections: map[string]*yaml.Node{}, cache: map[string][]item{}}
+	if _, err := auth.NewRBACConfig(configFile); err != nil {
+		c.add(nil, SeverityError, "failed to load RBAC config: %s", err.Error())
+	}
+	if _, err := statemachine.ChatBotFSM(configFile); err != nil {
+		c.add(nil, SeverityError, "failed to load state machine: %s", err.Error())
+	}
+	if err := c.parse(fileBytes); err != nil {
+		c.add(nil, SeverityError, "invalid YAML: %s", err.Error())
+		return c.sorted(), nil
+	}
+	c.checkRBAC()
+	c.checkFSM()
+	return c.sorted(), nil
+}
+
+func (c *checker) parse(fileBytes []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(fileBytes))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		root := doc.Content[0]
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			c.sections[root.Content[i].Value] = root.Content[i+1]
+		}
+	}
+}
+
+func (c *checker) add(n *yaml.Node, severity Severity, format string, args ...interface{}) {
+	p := Problem{Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if n != nil {
+		p.Line, p.Column = n.Line, n.Column
+	}
+	c.problems = append(c.problems, p)
+}
+
+func (c *checker) sorted() []Problem {
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		return c.problems[i].Line < c.problems[j].Line
+	})
+	return c.problems
+}
+
+// items returns the entries of a top level list keyed by idKey and reports duplicate ids
+func (c *checker) items(section, idKey string) []item {
+	if res, ok := c.cache[section]; ok {
+		return res
+	}
+	res := []item{}
+	seen := map[string]item{}
+	for _, n := range list(c.sections[section]) {
+		pos := mapValue(n, idKey)
+		id := scalar(pos)
+		if id == "" {
+			c.add(n, SeverityError, "%s entry has no %s", section, idKey)
+			continue
+		}
+		if first, ok := seen[id]; ok {
+			// the same anchor listed twice is harmless
+			if first.node != resolve(n) {
+				c.add(pos, SeverityError, "duplicate %s %s '%s', first defined on line %d", section, idKey, id, first.pos.Line)
+			}
+			continue
+		}
+		seen[id] = item{id: id, node: resolve(n), pos: pos}
+		res = append(res, seen[id])
+	}
+	c.cache[section] = res
+	return res
+}
+
+// checkRefs reports every entry of the list under key of n which is not in ids
+func (c *checker) checkRefs(n *yaml.Node, key, idKey, kind string, ids map[string]bool, owner string) {
+	for _, ref := range list(mapValue(n, key)) {
+		id := scalar(mapValue(ref, idKey))
+		if r := resolve(ref); r.Kind == yaml.ScalarNode {
+			id = r.Value
+		}
+		if !ids[id] {
+			c.add(ref, SeverityError, "%s refers to unknown %s '%s'", owner, kind, id)
+		}
+	}
+}
+
+// roles returns the roles defined at the top level and inline in users and groups, as the chatbot loads them.
+// Top level definitions take precedence
+func (c *checker) roles() []item {
+	res := append([]item{}, c.items("roles", "id")...)
+	seen := ids(res)
+	addInline := func(owner *yaml.Node) {
+		for _, n := range list(mapValue(owner, "roles")) {
+			pos := mapValue(n, "id")
+			if id := scalar(pos); id != "" && !seen[id] {
+				seen[id] = true
+				res = append(res, item{id: id, node: resolve(n), pos: pos})
+			}
+		}
+	}
+	for _, u := range c.items("users", "id") {
+		addInline(u.node)
+		for _, g := range list(mapValue(u.node, "groups")) {
+			addInline(g)
+		}
+	}
+	for _, g := range c.items("groups", "name") {
+		addInline(g.node)
+	}
+	return res
+}
+
+func (c *checker) checkRBAC() {
+	permissions := ids(c.items("permissions", "idstr"))
+	roles := ids(c.roles())
+	for _, r := range c.roles() {
+		owner := fmt.Sprintf("role '%s'", r.id)
+		c.checkRolePermissions(r.node, permissions, owner)
+		c.checkRefs(r.node, "parents", "id", "role", roles, owner)
+		if approvedBy := mapValue(r.node, "approvedBy"); approvedBy != nil {
+			if id := scalar(mapValue(approvedBy, "id")); !roles[id] {
+				c.add(approvedBy, SeverityError, "%s is approved by unknown role '%s'", owner, id)
+			}
+		}
+	}
+	c.checkRoleCycles()
+	for _, cmd := range c.items("commands", "id") {
+		owner := fmt.Sprintf("command '%s'", cmd.id)
+		c.checkRefs(cmd.node, "permissions", "idstr", "permission", permissions, owner)
+		approvedBy := mapValue(cmd.node, "approvedBy")
+		if approvedBy == nil {
+			c.add(cmd.pos, SeverityError, "%s has no approvedBy, users without permission cannot get it approved", owner)
+		} else if id := scalar(mapValue(approvedBy, "id")); !roles[id] {
+			c.add(approvedBy, SeverityError, "%s is approved by unknown role '%s'", owner, id)
+		}
+	}
+}
+
+// checkRolePermissions is checkRefs for role permissions, which may also be patterns matching defined permissions
+func (c *checker) checkRolePermissions(n *yaml.Node, permissions map[string]bool, owner string) {
+	for _, ref := range list(mapValue(n, "permissions")) {
+		id := scalar(mapValue(ref, "idstr"))
+		switch {
+		case !auth.IsGlob(id):
+			if !permissions[id] {
+				c.add(ref, SeverityError, "%s refers to unknown permission '%s'", owner, id)
+			}
+		case auth.CheckGlob(id) != nil:
+			c.add(ref, SeverityError, "%s has %s", owner, auth.CheckGlob(id).Error())
+		default:
+			matches := false
+			for p := range permissions {
+				matches = matches || auth.NewPermission(id).Match(auth.NewPermission(p))
+			}
+			if !matches {
+				c.add(ref, SeverityWarning, "%s has permission pattern '%s' which matches no permission", owner, id)
+			}
+		}
+	}
+}
+
+// checkRoleCycles reports roles which inherit from themselves through their parents
+func (c *checker) checkRoleCycles() {
+	parents := map[string][]string{}
+	for _, r := range c.roles() {
+		for _, p := range list(mapValue(r.node, "parents")) {
+			parents[r.id] = append(parents[r.id], scalar(mapValue(p, "id")))
+		}
+	}
+	for _, r := range c.roles() {
+		if cycle := findCycle(r.id, parents, []string{r.id}); cycle != nil {
+			c.add(r.pos, SeverityError, "role '%s' inherits from itself: %s", r.id, strings.Join(cycle, " -> "))
+		}
+	}
+}
+
+// findCycle returns the path from path[0] back to itself following edges, or nil if there is none
+func findCycle(start string, edges map[string][]string, path []string) []string {
+	last := path[len(path)-1]
+	for _, n := range edges[last] {
+		if n == start {
+			return append(path, n)
+		}
+		seen := false
+		for _, p := range path {
+			seen = seen || p == n
+		}
+		if seen {
+			continue
+		}
+		if res := findCycle(start, edges, append(path[:len(path):len(path)], n)); res != nil {
+			return res
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkFSM() {
+	states := c.items("states", "id")
+	events := c.items("events", "id")
+	stateIDs := ids(states)
+	eventIDs := ids(events)
+	commandIDs := ids(c.items("commands", "id"))
+	permissions := ids(c.items("permissions", "idstr"))
+
+	if !stateIDs[statemachine.InitialState] {
+		c.add(c.sections["states"], SeverityError, "there is no '%s' state, every conversation starts there", statemachine.InitialState)
+	}
+	knownSpecialTypes := map[string]bool{}
+	for _, t := range statemachine.KnownSpecialStateTypes {
+		knownSpecialTypes[string(t)] = true
+	}
+	for _, s := range states {
+		owner := fmt.Sprintf("state '%s'", s.id)
+		c.checkRefs(s.node, "permissions", "idstr", "permission", permissions, owner)
+		if handler := mapValue(s.node, "defaultHandler"); handler != nil {
+			if id := scalar(mapValue(handler, "id")); !commandIDs[id] {
+				c.add(handler, SeverityError, "%s has unknown defaultHandler '%s'", owner, id)
+			}
+		}
+		if t := mapValue(s.node, "specialStateType"); t != nil && !knownSpecialTypes[scalar(t)] {
+			c.add(t, SeverityError, "%s has unknown specialStateType '%s'", owner, scalar(t))
+		}
+	}
+
+	// state -> events leaving it and states reachable in 1 step
+	out := map[string][]item{}
+	next := map[string][]string{}
+	prev := map[string][]string{}
+	usedEvents := map[string]bool{}
+	for _, t := range list(c.sections["statemachine"]) {
+		nameNode := mapValue(t, "name")
+		name := scalar(nameNode)
+		if !eventIDs[name] {
+			c.add(nameNode, SeverityError, "transition uses event '%s' which is not defined in events, it would have no button", name)
+		}
+		usedEvents[name] = true
+		dstNode := mapValue(t, "dst")
+		dst := scalar(dstNode)
+		if !stateIDs[dst] {
+			c.add(dstNode, SeverityError, "transition '%s' goes to unknown state '%s'", name, dst)
+		}
+		for _, srcNode := range list(mapValue(t, "src")) {
+			src := scalar(srcNode)
+			if !stateIDs[src] {
+				c.add(srcNode, SeverityError, "transition '%s' starts from unknown state '%s'", name, src)
+				continue
+			}
+			for _, e := range out[src] {
+				if e.id == name {
+					c.add(nameNode, SeverityError, "state '%s' has more than one '%s' transition, first on line %d", src, name, e.pos.Line)
+				}
+			}
+			out[src] = append(out[src], item{id: name, pos: nameNode})
+			next[src] = append(next[src], dst)
+			prev[dst] = append(prev[dst], src)
+		}
+	}
+	for _, e := range events {
+		if !usedEvents[e.id] {
+			c.add(e.pos, SeverityWarning, "event '%s' is not used by any transition", e.id)
+		}
+	}
+	if stateIDs[statemachine.InitialState] {
+		hasGetStarted := false
+		for _, e := range out[statemachine.InitialState] {
+			hasGetStarted = hasGetStarted || e.id == getStartedEvent
+		}
+		if !hasGetStarted {
+			c.add(c.sections["statemachine"], SeverityError, "there is no '%s' transition from '%s', the Get Started button would do nothing", getStartedEvent, statemachine.InitialState)
+		}
+	}
+
+	reachable := walk(statemachine.InitialState, next)
+	canGoBack := walk(statemachine.InitialState, prev)
+	for _, s := range states {
+		if !reachable[s.id] {
+			c.add(s.pos, SeverityError, "state '%s' is unreachable from '%s'", s.id, statemachine.InitialState)
+		}
+		if len(out[s.id]) == 0 {
+			c.add(s.pos, SeverityError, "state '%s' is a dead end, add a Back transition", s.id)
+		} else if !canGoBack[s.id] {
+			c.add(s.pos, SeverityError, "there is no way back to '%s' from state '%s'", statemachine.InitialState, s.id)
+		}
+	}
+	c.checkOrderIDs(events, out)
+}
+
+// checkOrderIDs reports events shown in the same state with the same orderID, their button order would be random
+func (c *checker) checkOrderIDs(events []item, out map[string][]item) {
+	orderIDs := map[string]string{}
+	for _, e := range events {
+		orderIDs[e.id] = scalar(mapValue(e.node, "orderID"))
+	}
+	for _, s := range c.items("states", "id") {
+		seen := map[string]string{}
+		for _, e := range out[s.id] {
+			orderID := orderIDs[e.id]
+			if other, ok := seen[orderID]; ok && other != e.id {
+				c.add(e.pos, SeverityError, "events '%s' and '%s' of state '%s' have the same orderID %s", other, e.id, s.id, orderID)
+			}
+			seen[orderID] = e.id
+		}
+	}
+}
+
+// walk returns all states reachable from start following edges
+func walk(start string, edges map[string][]string) map[string]bool {
+	seen := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, n := range edges[s] {
+			if !seen[n] {
+				seen[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return seen
+}
+
+func ids(items []item) map[string]bool {
+	res := map[string]bool{}
+	for _, i := range items {
+		res[i.id] = true
+	}
+	return res
+}
+
+func resolve(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+func list(n *yaml.Node) []*yaml.Node {
+	if r := resolve(n); r != nil && r.Kind == yaml.SequenceNode {
+		return r.Content
+	}
+	return nil
+}
+
+// mapValue returns the value of key in mapping n. Aliases are not resolved so the position is where the value is used
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	r := resolve(n)
+	if r == nil || r.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(r.Content); i += 2 {
+		if r.Content[i].Value == key {
+			return r.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalar(n *yaml.Node) string {
+	if r := resolve(n); r != nil && r.Kind == yaml.ScalarNode {
+		return r.Value
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package configcheck
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfig has no problems. Test cases replace parts of it
+const validConfig = `
+permissions:
+- idstr: "run"
+roles:
+- id: "admin"
+  permissions:
+  - idstr: "run"
+commands:
+- id: "cmd"
+  cmd: "echo hi"
+  permissions:
+  - idstr: "run"
+  approvedBy:
+    id: "admin"
+groups:
+- name: "ops"
+  roles:
+  - id: "admin"
+users:
+- id: "1"
+  name: "One"
+  groups:
+  - name: "ops"
+---
+states:
+- id: "Initial"
+  message: "Start"
+- id: "Hello"
+  message: "Hi"
+  defaultHandler:
+    id: "cmd"
+events:
+- id: "GetStarted"
+  message: "Get Started"
+  orderID: 1
+- id: "Back"
+  message: "Back"
+  orderID: 2
+statemachine:
+- name: "GetStarted"
+  src:
+  - "Initial"
+  dst: "Hello"
+- name: "Back"
+  src:
+  - "Hello"
+  dst: "Initial"
+`
+
+func check(t *testing.T, config string) []Problem {
+	dir, err := ioutil.TempDir("", "configcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return problems
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		// pairs of old and new text, each replaced once in validConfig
+		replace      []string
+		wantSeverity Severity
+		// empty if the config must have no problems
+		wantMessage string
+	}{
+		{name: "valid"},
+		{
+			name:    "role defined inline in a group",
+			replace: []string{"  roles:\n  - id: \"admin\"\nusers:", "  roles:\n  - id: \"admin\"\n  - id: \"ops-lead\"\nusers:"},
+		},
+		{
+			name: "command approved by a role defined inline in a user",
+			replace: []string{
+				"    id: \"admin\"\ngroups:", "    id: \"lead\"\ngroups:",
+				"  groups:\n  - name: \"ops\"\n---", "  roles:\n  - id: \"lead\"\n  groups:\n  - name: \"ops\"\n---",
+			},
+		},
+		{
+			name: "command approved by a role defined inline in a user's group",
+			replace: []string{
+				"    id: \"admin\"\ngroups:", "    id: \"lead\"\ngroups:",
+				"  groups:\n  - name: \"ops\"\n---", "  groups:\n  - name: \"ops\"\n  - name: \"leads\"\n    roles:\n    - id: \"lead\"\n---",
+			},
+		},
+		{
+			name:         "unknown permission",
+			replace:      []string{"  permissions:\n  - idstr: \"run\"\ncommands:", "  permissions:\n  - idstr: \"walk\"\ncommands:"},
+			wantSeverity: SeverityError, wantMessage: "role 'admin' refers to unknown permission 'walk'",
+		},
+		{
+			name:         "permission pattern matching nothing",
+			replace:      []string{"  permissions:\n  - idstr: \"run\"\ncommands:", "  permissions:\n  - idstr: \"deploy-*\"\n  - idstr: \"run\"\ncommands:"},
+			wantSeverity: SeverityWarning, wantMessage: "permission pattern 'deploy-*' which matches no permission",
+		},
+		{
+			name:         "unknown parent",
+			replace:      []string{"roles:\n- id: \"admin\"\n", "roles:\n- id: \"admin\"\n  parents:\n  - id: \"root\"\n"},
+			wantSeverity: SeverityError, wantMessage: "role 'admin' refers to unknown role 'root'",
+		},
+		{
+			name:         "role cycle",
+			replace:      []string{"roles:\n", "roles:\n- id: \"a\"\n  parents:\n  - id: \"b\"\n- id: \"b\"\n  parents:\n  - id: \"a\"\n"},
+			wantSeverity: SeverityError, wantMessage: "role 'a' inherits from itself: a -> b -> a",
+		},
+		{
+			name:         "cycle through an inline role",
+			replace:      []string{"  - id: \"admin\"\nusers:", "  - id: \"ops-lead\"\n    parents:\n    - id: \"ops-lead\"\nusers:"},
+			wantSeverity: SeverityError, wantMessage: "role 'ops-lead' inherits from itself",
+		},
+		{
+			name:         "role approved by unknown role",
+			replace:      []string{"roles:\n- id: \"admin\"\n", "roles:\n- id: \"admin\"\n  approvedBy:\n    id: \"boss\"\n"},
+			wantSeverity: SeverityError, wantMessage: "role 'admin' is approved by unknown role 'boss'",
+		},
+		{
+			name:         "command without approvedBy",
+			replace:      []string{"  approvedBy:\n    id: \"admin\"\n", ""},
+			wantSeverity: SeverityError, wantMessage: "command 'cmd' has no approvedBy",
+		},
+		{
+			name:         "command approved by unknown role",
+			replace:      []string{"    id: \"admin\"\ngroups:", "    id: \"boss\"\ngroups:"},
+			wantSeverity: SeverityError, wantMessage: "command 'cmd' is approved by unknown role 'boss'",
+		},
+		{
+			name:         "command with unknown permission",
+			replace:      []string{"  cmd: \"echo hi\"\n  permissions:\n  - idstr: \"run\"", "  cmd: \"echo hi\"\n  permissions:\n  - idstr: \"fly\""},
+			wantSeverity: SeverityError, wantMessage: "command 'cmd' refers to unknown permission 'fly'",
+		},
+		{
+			name:         "duplicate id",
+			replace:      []string{"commands:\n", "commands:\n- id: \"cmd\"\n  approvedBy:\n    id: \"admin\"\n"},
+			wantSeverity: SeverityError, wantMessage: "duplicate commands id 'cmd'",
+		},
+		{
+			name:         "unknown default handler",
+			replace:      []string{"  defaultHandler:\n    id: \"cmd\"", "  defaultHandler:\n    id: \"other\""},
+			wantSeverity: SeverityError, wantMessage: "state 'Hello' has unknown defaultHandler 'other'",
+		},
+		{
+			name:         "unknown special state type",
+			replace:      []string{"  message: \"Hi\"\n", "  message: \"Hi\"\n  specialStateType: \"weather\"\n"},
+			wantSeverity: SeverityError, wantMessage: "state 'Hello' has unknown specialStateType 'weather'",
+		},
+		{
+			name:         "no initial state",
+			replace:      []string{"- id: \"Initial\"", "- id: \"Start\""},
+			wantSeverity: SeverityError, wantMessage: "there is no 'Initial' state",
+		},
+		{
+			name:         "transition with unknown event",
+			replace:      []string{"- name: \"Back\"", "- name: \"Return\""},
+			wantSeverity: SeverityError, wantMessage: "transition uses event 'Return' which is not defined in events",
+		},
+		{
+			name:         "transition to unknown state",
+			replace:      []string{"  dst: \"Initial\"", "  dst: \"Nowhere\""},
+			wantSeverity: SeverityError, wantMessage: "transition 'Back' goes to unknown state 'Nowhere'",
+		},
+		{
+			name:         "transition from unknown state",
+			replace:      []string{"  - \"Hello\"\n  dst: \"Initial\"", "  - \"Hello\"\n  - \"Nowhere\"\n  dst: \"Initial\""},
+			wantSeverity: SeverityError, wantMessage: "transition 'Back' starts from unknown state 'Nowhere'",
+		},
+		{
+			name:         "duplicate transition",
+			replace:      []string{"statemachine:\n", "statemachine:\n- name: \"Back\"\n  src:\n  - \"Hello\"\n  dst: \"Hello\"\n"},
+			wantSeverity: SeverityError, wantMessage: "state 'Hello' has more than one 'Back' transition",
+		},
+		{
+			name:         "unused event",
+			replace:      []string{"events:\n", "events:\n- id: \"Help\"\n  message: \"Help\"\n  orderID: 3\n"},
+			wantSeverity: SeverityWarning, wantMessage: "event 'Help' is not used by any transition",
+		},
+		{
+			name:         "no GetStarted transition",
+			replace:      []string{"- name: \"GetStarted\"\n  src:", "- name: \"Back\"\n  src:"},
+			wantSeverity: SeverityError, wantMessage: "there is no 'GetStarted' transition from 'Initial'",
+		},
+		{
+			name:         "unreachable state",
+			replace:      []string{"events:\n", "- id: \"Lost\"\n  message: \"Lost\"\nevents:\n"},
+			wantSeverity: SeverityError, wantMessage: "state 'Lost' is unreachable from 'Initial'",
+		},
+		{
+			name:         "dead end",
+			replace:      []string{"  src:\n  - \"Hello\"\n  dst: \"Initial\"", "  src:\n  - \"Initial\"\n  dst: \"Initial\""},
+			wantSeverity: SeverityError, wantMessage: "state 'Hello' is a dead end",
+		},
+		{
+			name:         "no way back",
+			replace:      []string{"  src:\n  - \"Hello\"\n  dst: \"Initial\"", "  src:\n  - \"Hello\"\n  dst: \"Hello\""},
+			wantSeverity: SeverityError, wantMessage: "there is no way back to 'Initial' from state 'Hello'",
+		},
+		{
+			name:         "same orderID",
+			replace:      []string{"orderID: 2", "orderID: 1", "  src:\n  - \"Hello\"\n  dst: \"Initial\"", "  src:\n  - \"Hello\"\n  dst: \"Initial\"\n- name: \"GetStarted\"\n  src:\n  - \"Hello\"\n  dst: \"Hello\""},
+			wantSeverity: SeverityError, wantMessage: "events 'Back' and 'GetStarted' of state 'Hello' have the same orderID 1",
+		},
+		{
+			name:         "invalid YAML",
+			replace:      []string{"states:\n", "states: [\n"},
+			wantSeverity: SeverityError, wantMessage: "invalid YAML",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig
+			for i := 0; i+1 < len(tt.replace); i += 2 {
+				if !strings.Contains(config, tt.replace[i]) {
+					t.Fatalf("config does not contain %q", tt.replace[i])
+				}
+				config = strings.Replace(config, tt.replace[i], tt.replace[i+1], 1)
+			}
+			problems := check(t, config)
+			if tt.wantMessage == "" {
+				if len(problems) != 0 {
+					t.Fatalf("got problems %v", problems)
+				}
+				return
+			}
+			for _, p := range problems {
+				if p.Severity == tt.wantSeverity && strings.Contains(p.Message, tt.wantMessage) {
+					return
+				}
+			}
+			t.Fatalf("got %v, want %s '%s'", problems, tt.wantSeverity, tt.wantMessage)
+		})
+	}
+}
+
+func TestCheckShippedConfig(t *testing.T) {
+	if problems := check(t, readFile(t, "../config/viktorwebservices.yaml")); len(problems) != 0 {
+		t.Fatalf("shipped config has problems: %v", problems)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
@@ -1,9 +1,13 @@
 package executor
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
 
@@ -14,20 +18,192 @@ import (
 const (
 	InfraCli = "infra_cli"
 	bashCli  = "/bin/sh"
+
+	// Input modes for commands with argv
+	InputModeStdin = "stdin"
+	InputModeEnv   = "env"
+
+	// InputEnvVar holds the user input in env input mode
+	InputEnvVar = "INPUT"
+	// Prefix of the env variables holding named input fields
+	fieldEnvVarPrefix = "INPUT_"
 )
 
+// FieldEnvVar returns the env variable a named input field is passed in
+func FieldEnvVar(name string) string {
+	return fieldEnvVarPrefix + strings.ToUpper(name)
+}
+
+// TimeoutError is returned when a command is killed because it ran longer than its timeout
+type TimeoutError struct {
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.After)
+}
+
 // Execute runs the given command blocking
 func Execute(cmd auth.Command, input string) (string, error) {
-	bashCmd := fmt.Sprintf("echo '%s' | while read -r line; do\n %s\n done", input, cmd.CMD)
-	c := exec.Command("/bin/sh", "-c", bashCmd)
+	return ExecuteStream(cmd, input, nil, nil)
+}
+
+// ExecuteStream runs the given command blocking and calls onLine with every line of output as it is produced.
+// fields are named inputs passed as env variables (see FieldEnvVar). fields and onLine may be nil.
+func ExecuteStream(cmd auth.Command, input string, fields map[string]string, onLine func(string)) (string, error) {
+	c, err := command(cmd, input, fields)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to build cmd '%s'", cmd.PrettyName)
+	}
 	glog.Infof(strings.Repeat("-", 40))
 	glog.Infof("Command: %+v, input: %s", cmd, input)
 	// glog.Infof("executing: '%s'", c.String())
-	output, err := c.CombinedOutput()
+	output := &limitedBuffer{max: cmd.MaxOutputBytes}
+	c.Stdout = output
+	if onLine != nil {
+		c.Stdout = &lineWriter{w: output, onLine: onLine}
+	}
+	c.Stderr = c.Stdout
+	err = run(c, cmd.Timeout)
+	if lw, ok := c.Stdout.(*lineWriter); ok {
+		lw.Flush()
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to execute cmd: '%s' with error '%s'.\n Command output: %s", cmd.PrettyName, err.Error(), string(output))
+		if timeoutErr, ok := err.(*TimeoutError); ok {
+			glog.Warningf("cmd '%s' %s, killed its process group. Output so far: %s", cmd.PrettyName, timeoutErr.Error(), output.String())
+			return output.String(), timeoutErr
+		}
+		return "", errors.Wrapf(err, "failed to execute cmd: '%s' with error '%s'.\n Command output: %s", cmd.PrettyName, err.Error(), output.String())
 	}
-	glog.Infof("cmd combined output: %s", string(output))
+	glog.Infof("cmd combined output: %s", output.String())
 	glog.Infof(strings.Repeat("-", 40))
-	return string(output), nil
+	return output.String(), nil
+}
+
+// run starts c in its own process group and kills the whole group if it does not finish within timeout
+func run(c *exec.Cmd, timeout time.Duration) error {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	if timeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		// negative pid kills the process group, including anything the command spawned
+		if err := syscall.Kill(-c.Process.Pid, syscall.SIGKILL); err != nil {
+			glog.Errorf("failed to kill process group %d: %s", c.Process.Pid, err.Error())
+		}
+		<-done
+		return &TimeoutError{After: timeout}
+	}
+}
+
+func command(cmd auth.Command, input string, fields map[string]string) (*exec.Cmd, error) {
+	var c *exec.Cmd
+	if len(cmd.Argv) == 0 {
+		c = shellCommand(cmd, input)
+	} else {
+		var err error
+		if c, err = argvCommand(cmd, input); err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) > 0 {
+		if c.Env == nil {
+			c.Env = os.Environ()
+		}
+		for name, value := range fields {
+			c.Env = append(c.Env, FieldEnvVar(name)+"="+value)
+		}
+	}
+	return withLimits(c, cmd.Limits)
+}
+
+// shellCommand runs cmd.CMD once for every line of input, available as $line.
+// Input is fed through stdin so it is never interpreted by the shell.
+func shellCommand(cmd auth.Command, input string) *exec.Cmd {
+	bashCmd := fmt.Sprintf("while read -r line; do\n %s\n done", cmd.CMD)
+	c := exec.Command(bashCli, "-c", bashCmd)
+	c.Stdin = strings.NewReader(input + "\n")
+	return c
+}
+
+// argvCommand executes cmd.Argv directly. Input never becomes part of the command line
+// so quotes, $() and newlines in it have no special meaning.
+func argvCommand(cmd auth.Command, input string) (*exec.Cmd, error) {
+	c := exec.Command(cmd.Argv[0], cmd.Argv[1:]...)
+	switch cmd.InputMode {
+	case "", InputModeStdin:
+		c.Stdin = strings.NewReader(input + "\n")
+	case InputModeEnv:
+		c.Env = append(os.Environ(), InputEnvVar+"="+input)
+	default:
+		return nil, fmt.Errorf("unknown input mode '%s'", cmd.InputMode)
+	}
+	return c, nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		b.buf.Write(p[:b.max-b.buf.Len()])
+		b.truncated = true
+		// pretend everything was written so the command is not killed by SIGPIPE
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + fmt.Sprintf("\n[output truncated to %d bytes]", b.max)
+	}
+	return b.buf.String()
+}
+
+// lineWriter passes everything to w and calls onLine for each complete line
+type lineWriter struct {
+	w       *limitedBuffer
+	onLine  func(string)
+	partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	before := l.w.buf.Len()
+	n, err := l.w.Write(p)
+	// only stream what has not been truncated
+	l.partial = append(l.partial, p[:l.w.buf.Len()-before]...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.onLine(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+	}
+	return n, err
+}
+
+// Flush emits the last line if it was not terminated by a newline
+func (l *lineWriter) Flush() {
+	if len(l.partial) > 0 {
+		l.onLine(string(l.partial))
+		l.partial = nil
+	}
 }
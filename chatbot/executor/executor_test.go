@@ -0,0 +1,186 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+)
+
+// Input given to argv commands reaches them byte for byte and is never run by a shell
+func TestArgvInputIsInert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "pwned")
+
+	inputs := []string{
+		"'; touch " + marker + "; echo '",
+		"\"; touch " + marker + "; echo \"",
+		"$(touch " + marker + ")",
+		"`touch " + marker + "`",
+		"a\nb",
+		"a\ntouch " + marker,
+		"x; touch " + marker + " && echo $HOME | cat",
+	}
+	commands := []struct {
+		name string
+		cmd  auth.Command
+		// expected output for the given input
+		want func(input string) string
+	}{
+		{
+			name: "stdin",
+			cmd:  auth.Command{Argv: []string{"cat"}},
+			want: func(input string) string { return input + "\n" },
+		},
+		{
+			name: "env",
+			cmd:  auth.Command{Argv: []string{"/bin/sh", "-c", `printf %s "$INPUT"`}, InputMode: InputModeEnv},
+			want: func(input string) string { return input },
+		},
+		{
+			name: "stdin with limits",
+			cmd:  auth.Command{Argv: []string{"cat"}, Limits: auth.ResourceLimits{CPUSeconds: 10}},
+			want: func(input string) string { return input + "\n" },
+		},
+		{
+			name: "env with limits",
+			cmd:  auth.Command{Argv: []string{"/bin/sh", "-c", `printf %s "$INPUT"`}, InputMode: InputModeEnv, Limits: auth.ResourceLimits{CPUSeconds: 10}},
+			want: func(input string) string { return input },
+		},
+	}
+	for _, c := range commands {
+		for _, input := range inputs {
+			out, err := Execute(c.cmd, input)
+			if err != nil {
+				t.Errorf("%s %q: %s", c.name, input, err)
+				continue
+			}
+			if out != c.want(input) {
+				t.Errorf("%s %q: got output %q, want %q", c.name, input, out, c.want(input))
+			}
+			if _, err := os.Stat(marker); !os.IsNotExist(err) {
+				t.Fatalf("%s %q: input was executed", c.name, input)
+			}
+		}
+	}
+}
+
+func TestArgvUnknownInputMode(t *testing.T) {
+	if _, err := Execute(auth.Command{Argv: []string{"cat"}, InputMode: "args"}, "x"); err == nil {
+		t.Error("expected an error for an unknown input mode")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits := auth.ResourceLimits{CPUSeconds: 7, MemoryMB: 512, Processes: 300}
+	commands := []struct {
+		name string
+		cmd  auth.Command
+	}{
+		{name: "shell", cmd: auth.Command{CMD: "cat /proc/self/limits", Limits: limits}},
+		{name: "argv", cmd: auth.Command{Argv: []string{"cat", "/proc/self/limits"}, Limits: limits}},
+	}
+	for _, c := range commands {
+		out, err := Execute(c.cmd, "x")
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		for _, want := range []*regexp.Regexp{
+			regexp.MustCompile(`Max cpu time\s+7\s+7\s`),
+			regexp.MustCompile(`Max address space\s+536870912\s+536870912\s`),
+			regexp.MustCompile(`Max processes\s+300\s+300\s`),
+		} {
+			if !want.MatchString(out) {
+				t.Errorf("%s: limits do not match %s:\n%s", c.name, want, out)
+			}
+		}
+	}
+}
+
+func TestCPULimitStopsCommand(t *testing.T) {
+	start := time.Now()
+	_, err := Execute(auth.Command{CMD: "while :; do :; done", Limits: auth.ResourceLimits{CPUSeconds: 1}, Timeout: 30 * time.Second}, "x")
+	if err == nil {
+		t.Fatal("busy loop finished despite the CPU limit")
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		t.Fatalf("busy loop ran until the timeout, the CPU limit did not apply")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("busy loop ran for %s", d)
+	}
+}
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	start := time.Now()
+	// the background sleep would outlive its parent shell unless the whole group is killed
+	out, err := Execute(auth.Command{CMD: "sleep 60 & echo $! > " + pidFile + "; echo started; wait", Timeout: 500 * time.Millisecond}, "x")
+	timeoutErr, ok := err.(*TimeoutError)
+	if !ok || timeoutErr.After != 500*time.Millisecond {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("command ran for %s after its timeout", d)
+	}
+	if out != "started\n" {
+		t.Errorf("got output %q, want the output before the timeout", out)
+	}
+
+	pidBytes, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d spawned by the command survived the timeout", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// processRunning returns false if pid does not exist or is a zombie waiting to be reaped
+func processRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestOutputIsCapped(t *testing.T) {
+	out, err := Execute(auth.Command{CMD: "head -c 100000 /dev/zero | tr '\\0' a", MaxOutputBytes: 1000}, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, strings.Repeat("a", 1000)+"\n[output truncated to 1000 bytes]") {
+		t.Fatalf("got %d bytes of output: %.50q...", len(out), out)
+	}
+}
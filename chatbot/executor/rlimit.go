@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+)
+
+/* Go cannot set rlimits between fork and exec, and `ulimit -u` is not available in every /bin/sh (dash has no -u).
+So commands with limits are started through the running binary itself: when its arguments start with
+rlimitHelperArg, init sets the limits with setrlimit(2) and execs the command in place.
+
+	<this binary> __executor-rlimits <cpu seconds> <memory MB> <processes> <command path> <args>...
+*/
+
+const (
+	rlimitHelperArg = "__executor-rlimits"
+
+	// RLIMIT_NPROC on linux, which the syscall package does not define
+	rlimitNproc = 0x6
+)
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == rlimitHelperArg {
+		if err := execWithLimits(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to apply resource limits: %s\n", err.Error())
+			os.Exit(126)
+		}
+	}
+}
+
+// withLimits returns a command which applies limits and then runs c with the same arguments, input and env.
+// Commands without limits are returned as they are
+func withLimits(c *exec.Cmd, limits auth.ResourceLimits) (*exec.Cmd, error) {
+	if limits == (auth.ResourceLimits{}) {
+		return c, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the chatbot binary to apply resource limits: %s", err.Error())
+	}
+	args := []string{rlimitHelperArg, strconv.Itoa(limits.CPUSeconds), strconv.Itoa(limits.MemoryMB), strconv.Itoa(limits.Processes), c.Path}
+	wrapped := exec.Command(self, append(args, c.Args[1:]...)...)
+	wrapped.Stdin = c.Stdin
+	wrapped.Env = c.Env
+	return wrapped, nil
+}
+
+// execWithLimits sets the limits given as arguments on the current process and replaces it with the command.
+// It only returns on error
+func execWithLimits(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("expected limits and a command, got %q", args)
+	}
+	resources := []struct {
+		resource int
+		// multiplier from the config unit to the rlimit unit
+		unit uint64
+	}{
+		{resource: syscall.RLIMIT_CPU, unit: 1},
+		{resource: syscall.RLIMIT_AS, unit: 1024 * 1024},
+		{resource: rlimitNproc, unit: 1},
+	}
+	for i, r := range resources {
+		value, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit '%s'", args[i])
+		}
+		if value == 0 {
+			continue
+		}
+		limit := &syscall.Rlimit{Cur: value * r.unit, Max: value * r.unit}
+		if err := syscall.Setrlimit(r.resource, limit); err != nil {
+			return fmt.Errorf("failed to set limit %d to %d: %s", r.resource, limit.Cur, err.Error())
+		}
+	}
+	path := args[3]
+	return syscall.Exec(path, append([]string{path}, args[4:]...), os.Environ())
+}
@@ -0,0 +1,218 @@
+package chatbot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	grantsBucket = "grants"
+
+	// Longest time a role can be granted for
+	maxGrantDuration = 30 * 24 * time.Hour
+)
+
+var (
+	// e.g "grant admin to 1234567890 for 2h"
+	grantCommandRe  = regexp.MustCompile(`^(?i:grant)\s+(\S+)\s+(?i:to)\s+([0-9]+)\s+(?i:for)\s+(\S+)$`)
+	revokeCommandRe = regexp.MustCompile(`^(?i:revoke)\s+(\S+)$`)
+)
+
+const grantsUsage = "Send 'grant <role> to <user id> for <duration>' e.g 'grant admin to 1234567890 for 2h' to give someone a role for a while, or 'revoke <grant id>' to take it back early."
+
+// GrantStore keeps the temporary roles issued from chat
+type GrantStore struct {
+	store storage.Store
+}
+
+func NewGrantStore(s storage.Store) *GrantStore {
+	return &GrantStore{store: s}
+}
+
+func (g *GrantStore) Save(grant auth.Grant) error {
+	if err := g.store.Put(grantsBucket, grant.ID, grant); err != nil {
+		return errors.Wrapf(err, "failed to store grant %s", grant.ID)
+	}
+	return nil
+}
+
+// Get returns the grant with the given id
+func (g *GrantStore) Get(id string) (auth.Grant, bool, error) {
+	var grant auth.Grant
+	found, err := g.store.Get(grantsBucket, id, &grant)
+	if err != nil {
+		return auth.Grant{}, false, errors.Wrapf(err, "failed to get grant %s", id)
+	}
+	return grant, found, nil
+}
+
+func (g *GrantStore) Delete(id string) error {
+	if err := g.store.Delete(grantsBucket, id); err != nil {
+		return errors.Wrapf(err, "failed to delete grant %s", id)
+	}
+	return nil
+}
+
+// All returns every stored grant, including expired ones which have not been cleaned up yet
+func (g *GrantStore) All() ([]auth.Grant, error) {
+	ids, err := g.store.Keys(grantsBucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list grants")
+	}
+	res := []auth.Grant{}
+	for _, id := range ids {
+		grant, found, err := g.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			res = append(res, grant)
+		}
+	}
+	return res, nil
+}
+
+// listGrants shows the active grants when entering the grants state
+func listGrants(c *ChatbotHandler, user auth.User) (string, error) {
+	grants, err := c.Grants.All()
+	if err != nil {
+		glog.Errorf("failed to list grants: %s", err.Error())
+		return "", fmt.Errorf("Failed to list grants")
+	}
+	lines := []string{}
+	now := time.Now()
+	for _, g := range grants {
+		if g.Active(now) {
+			lines = append(lines, formatGrant(c, g))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "There are no active grants.")
+	}
+	return fmt.Sprintf("%s\n\n%s", strings.Join(lines, "\n"), grantsUsage), nil
+}
+
+func formatGrant(c *ChatbotHandler, g auth.Grant) string {
+	return fmt.Sprintf("- %s: '%s' for %s(ID: %s) %s, granted by %s", g.ID, g.Role, c.RBAC().WhoAmI(g.UserID).Name, g.UserID, g.Until(), g.GrantedBy.Name)
+}
+
+// manageGrants processes grant and revoke commands sent in the grants state
+func manageGrants(c *ChatbotHandler, user auth.User, input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if m := grantCommandRe.FindStringSubmatch(input); m != nil {
+		return grantRole(c, user, m[1], m[2], m[3])
+	}
+	if m := revokeCommandRe.FindStringSubmatch(input); m != nil {
+		return revokeGrant(c, user, m[1])
+	}
+	return "", fmt.Errorf("Could not understand '%s'. %s", input, grantsUsage)
+}
+
+func grantRole(c *ChatbotHandler, user auth.User, roleName, userID, duration string) (string, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("Invalid duration '%s', use e.g 30m or 2h", duration)
+	}
+	if d > maxGrantDuration {
+		return "", fmt.Errorf("Roles can be granted for at most %s, add the user to the config file instead", maxGrantDuration)
+	}
+	rbac := c.RBAC()
+	role, ok := rbac.FindRole(roleName)
+	if !ok {
+		return "", fmt.Errorf("There is no role '%s'", roleName)
+	}
+	// only roles given by the config file can be passed on, so a grant cannot be extended by its holder
+	rbac.Grants = nil
+	if !rbac.UserHasRole(user, role) {
+		glog.Warningf("user %s tried to grant role '%s' they do not have to %s", user.ID, roleName, userID)
+		return "", fmt.Errorf("You can only grant roles you have yourself")
+	}
+
+	now := time.Now()
+	g := auth.Grant{
+		ID:        uuid.New().String()[:8],
+		UserID:    userID,
+		Role:      roleName,
+		GrantedBy: auth.User{ID: user.ID, Name: user.Name},
+		GrantedAt: now,
+		ExpiresAt: now.Add(d),
+	}
+	if err := c.Grants.Save(g); err != nil {
+		glog.Errorf("failed to save grant: %s", err.Error())
+		return "", fmt.Errorf("Failed to save the grant, please try again")
+	}
+	glog.Infof("user %s granted role '%s' to %s until %s (grant %s)", user.ID, roleName, userID, g.ExpiresAt, g.ID)
+	msg := fmt.Sprintf("%s has given you the '%s' role until %s.", user.Name, roleName, g.ExpiresAt.Format(time.RFC1123))
+	if err := fbapi.SendRawMessage(userID, msg); err != nil {
+		glog.Warningf("failed to notify %s about grant %s: %s", userID, g.ID, err.Error())
+	}
+	return fmt.Sprintf("Granted:\n%s", formatGrant(c, g)), nil
+}
+
+func revokeGrant(c *ChatbotHandler, user auth.User, id string) (string, error) {
+	g, found, err := c.Grants.Get(id)
+	if err != nil {
+		glog.Errorf("failed to get grant %s: %s", id, err.Error())
+		return "", fmt.Errorf("Failed to read grant '%s'", id)
+	}
+	if !found || !g.Active(time.Now()) {
+		return "", fmt.Errorf("There is no active grant '%s'", id)
+	}
+	rbac := c.RBAC()
+	rbac.Grants = nil
+	if !rbac.UserHasRole(user, auth.Role{Name: g.Role}) && !canApproveRole(rbac, user, g.Role) {
+		glog.Warningf("user %s tried to revoke grant %s of role '%s' they neither have nor approve", user.ID, g.ID, g.Role)
+		return "", fmt.Errorf("You can only revoke roles you have yourself or approve requests for")
+	}
+	if err := c.Grants.Delete(id); err != nil {
+		glog.Errorf("failed to revoke grant %s: %s", id, err.Error())
+		return "", fmt.Errorf("Failed to revoke grant '%s', please try again", id)
+	}
+	glog.Infof("user %s revoked grant %s of role '%s' to %s", user.ID, g.ID, g.Role, g.UserID)
+	msg := fmt.Sprintf("%s has taken back the '%s' role you were given %s.", user.Name, g.Role, g.Until())
+	if err := fbapi.SendRawMessage(g.UserID, msg); err != nil {
+		glog.Warningf("failed to notify %s about revoked grant %s: %s", g.UserID, g.ID, err.Error())
+	}
+	return fmt.Sprintf("Revoked the '%s' role of %s.", g.Role, g.UserID), nil
+}
+
+// canApproveRole returns true if user is in the approvedBy role of role
+func canApproveRole(rbac auth.RBACConfig, user auth.User, role string) bool {
+	if r, ok := rbac.FindRole(role); ok && r.ApprovedBy != nil {
+		return rbac.UserHasRole(user, *r.ApprovedBy)
+	}
+	return false
+}
+
+// expireGrants deletes the grants which have expired and lets their holders know
+func (c *ChatbotHandler) expireGrants(now time.Time) {
+	grants, err := c.Grants.All()
+	if err != nil {
+		glog.Errorf("failed to list grants: %s", err.Error())
+		return
+	}
+	for _, g := range grants {
+		if g.Active(now) {
+			continue
+		}
+		if err := c.Grants.Delete(g.ID); err != nil {
+			glog.Errorf("failed to delete expired grant %s: %s", g.ID, err.Error())
+			continue
+		}
+		glog.Infof("grant %s of role '%s' to %s expired", g.ID, g.Role, g.UserID)
+		msg := fmt.Sprintf("The '%s' role %s gave you has expired.", g.Role, g.GrantedBy.Name)
+		if err := fbapi.SendRawMessage(g.UserID, msg); err != nil {
+			glog.Warningf("failed to notify %s about expired grant %s: %s", g.UserID, g.ID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package chatbot
+
+import (
+	"strings"
+	"testing"
+)
+
+// grantID returns the id of the active grant of role to userID, empty if there is none
+func grantID(t *testing.T, c *ChatbotHandler, userID, role string) string {
+	grants, err := c.Grants.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range grants {
+		if g.UserID == userID && g.Role == role {
+			return g.ID
+		}
+	}
+	return ""
+}
+
+func TestGrantAndRevoke(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	const holder, other = "1111", "2222"
+	admin := c.RBAC().WhoAmI(testAdminID)
+
+	if out, err := manageGrants(c, admin, "grant admin to "+holder+" for 2h"); err != nil || !strings.Contains(out, "Granted") {
+		t.Fatalf("admin could not grant their role: %s %v", out, err)
+	}
+	id := grantID(t, c, holder, "admin")
+	if id == "" || !isAdmin(c, holder) {
+		t.Fatal("grant did not give the role")
+	}
+
+	// a grant cannot be passed on or extended by its holder
+	if _, err := manageGrants(c, c.RBAC().WhoAmI(holder), "grant admin to "+other+" for 2h"); err == nil {
+		t.Fatal("grant holder passed the role on")
+	}
+	if _, err := manageGrants(c, c.RBAC().WhoAmI(holder), "grant admin to "+holder+" for 720h"); err == nil {
+		t.Fatal("grant holder extended their grant")
+	}
+	if _, err := manageGrants(c, c.RBAC().WhoAmI(other), "grant friend to "+other+" for 2h"); err == nil {
+		t.Fatal("user without the role granted it")
+	}
+	if _, err := manageGrants(c, admin, "grant nobody to "+other+" for 2h"); err == nil || !strings.Contains(err.Error(), "There is no role 'nobody'") {
+		t.Fatalf("got %v for an unknown role", err)
+	}
+	if _, err := manageGrants(c, admin, "grant admin to "+other+" for 721h"); err == nil {
+		t.Fatal("granted a role for longer than the max duration")
+	}
+
+	if _, err := manageGrants(c, c.RBAC().WhoAmI(other), "revoke "+id); err == nil {
+		t.Fatal("user without the role revoked the grant")
+	}
+	if out, err := manageGrants(c, admin, "revoke "+id); err != nil || !strings.Contains(out, "Revoked") {
+		t.Fatalf("admin could not revoke the grant: %s %v", out, err)
+	}
+	if grantID(t, c, holder, "admin") != "" || isAdmin(c, holder) {
+		t.Fatal("revoked grant still gives the role")
+	}
+}
+
+func TestGrantInlineRole(t *testing.T) {
+	stubSendAPI(t)
+	c, edit := newReloadableHandler(t)
+	// a role only defined in the group of the config admin
+	edit("  roles:\n  - *admin-role\n", "  roles:\n  - *admin-role\n  - id: \"oncall\"\n    permissions:\n    - *perm-get-info\n")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	const holder = "1111"
+	if out, err := manageGrants(c, c.RBAC().WhoAmI(testAdminID), "grant oncall to "+holder+" for 2h"); err != nil {
+		t.Fatalf("could not grant an inline role: %s %v", out, err)
+	}
+	rbac := c.RBAC()
+	oncall, ok := rbac.FindRole("oncall")
+	if !ok || !rbac.UserHasRole(rbac.WhoAmI(holder), oncall) {
+		t.Fatal("grant of an inline role did not give it")
+	}
+}
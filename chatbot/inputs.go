@@ -0,0 +1,101 @@
+package chatbot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
+
+	"github.com/golang/glog"
+)
+
+/* States with `inputs:` ask the user for each field in turn. Answers are validated against the field
+and kept in the user's Conversation until the last one arrives, then the state's defaultHandler is run
+with the fields as env variables (see executor.FieldEnvVar).
+*/
+
+// Answer which leaves an optional field empty
+const skipInputAnswer = "skip"
+
+// nextInput returns the first field of state which has not been answered yet
+func nextInput(state statemachine.State, answered map[string]string) (validation.Field, bool) {
+	for _, f := range state.Inputs {
+		if _, ok := answered[f.Name]; !ok {
+			return f, true
+		}
+	}
+	return validation.Field{}, false
+}
+
+// askFirstInput asks for the first field of a state the user has just entered
+func askFirstInput(state statemachine.State, moveFSMResult *MoveFSMResult) {
+	if field, ok := nextInput(state, nil); ok {
+		moveFSMResult.CmdOutput = state.Message + "\n\n" + field.PromptText()
+	}
+}
+
+// collectInput records answer for the next field of state and asks for the one after it.
+// Once all fields are answered the default handler is run and the pending input is returned.
+func (c *ChatbotHandler) collectInput(user auth.User, state statemachine.State, answer string, moveFSMResult *MoveFSMResult) (string, error) {
+	conv, _, err := c.Conversations.Load(user.ID)
+	if err != nil {
+		return "", err
+	}
+	field, ok := nextInput(state, conv.Fields)
+	if !ok {
+		// answers left over from an earlier run, start again
+		conv.Fields = nil
+		field, _ = nextInput(state, nil)
+	}
+	value := strings.TrimSpace(answer)
+	if !field.Required && strings.EqualFold(value, skipInputAnswer) {
+		value = ""
+	}
+	if err := field.Validate(value); err != nil {
+		glog.Warningf("user %s sent invalid value for input '%s' of state '%s': %s", user.ID, field.Name, state.Name, err.Error())
+		moveFSMResult.CmdOutput = fmt.Sprintf("Invalid input: %s.\n\n%s", err.Error(), field.PromptText())
+		return "", nil
+	}
+	if conv.Fields == nil {
+		conv.Fields = map[string]string{}
+	}
+	conv.Fields[field.Name] = value
+	if next, ok := nextInput(state, conv.Fields); ok {
+		moveFSMResult.CmdOutput = next.PromptText()
+		return "", c.Conversations.Save(user.ID, conv)
+	}
+
+	fields := conv.Fields
+	conv.Fields = nil
+	if err := c.Conversations.Save(user.ID, conv); err != nil {
+		return "", err
+	}
+	glog.Infof("collected all inputs of state '%s' for user %s", state.Name, user.ID)
+	return c.runDefaultHandler(user, state, inputLine(state, fields), fields, false, moveFSMResult), nil
+}
+
+// inputLine joins the field values in declaration order. It is what commands see as $line
+func inputLine(state statemachine.State, fields map[string]string) string {
+	values := []string{}
+	for _, f := range state.Inputs {
+		values = append(values, fields[f.Name])
+	}
+	return strings.Join(values, " ")
+}
+
+// formatFields returns one "name: value" line per field, sorted by name
+func formatFields(fields map[string]string) string {
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, fields[name]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// outputCipher encrypts job outputs at rest with AES-256-GCM.
+// Outputs may contain secrets e.g the private key in a Wireguard config.
+type outputCipher struct {
+	aead cipher.AEAD
+}
+
+// newOutputCipher derives an AES-256 key from key, which may be of any length
+func newOutputCipher(key []byte) (*outputCipher, error) {
+	derived := sha256.Sum256(key)
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM cipher")
+	}
+	return &outputCipher{aead: aead}, nil
+}
+
+// encrypt returns nonce + ciphertext. The job id is authenticated so outputs cannot be swapped between jobs
+func (c *outputCipher) encrypt(jobID, plaintext string) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return c.aead.Seal(nonce, nonce, []byte(plaintext), []byte(jobID)), nil
+}
+
+func (c *outputCipher) decrypt(jobID string, sealed []byte) (string, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("encrypted output is too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(jobID))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt output, was the encryption key changed?")
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,334 @@
+// Package jobs runs chatbot commands on a bounded worker pool and keeps a history of what ran
+package jobs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/executor"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	jobsBucket = "jobs"
+
+	// Output stored in the job history is truncated to this many bytes
+	maxStoredOutput = 16384
+	// Max number of jobs waiting for a free worker
+	maxQueuedJobs = 100
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusTimeout   Status = "timeout"
+)
+
+// Job is a single execution of a command
+type Job struct {
+	ID      string `json:"id"`
+	CmdID   string `json:"cmdID"`
+	CmdName string `json:"cmdName"`
+	Input   string `json:"input"`
+	// Named input fields, passed to the command as env variables
+	Fields    map[string]string `json:"fields,omitempty"`
+	Status    Status            `json:"status"`
+	Requester auth.User         `json:"requester"`
+	// Moderator who approved the execution. Nil if the requester had permission
+	Approver  *auth.User `json:"approver,omitempty"`
+	QueuedAt  time.Time  `json:"queuedAt"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   time.Time  `json:"endedAt"`
+	// Truncated combined output of the command. Only stored encrypted
+	Output          string `json:"-"`
+	EncryptedOutput []byte `json:"encryptedOutput,omitempty"`
+	// Set once the output has been deleted after the retention period
+	OutputPruned bool `json:"outputPruned,omitempty"`
+}
+
+// Config configures a Queue
+type Config struct {
+	// Max number of jobs executing at the same time
+	Workers int
+	// Key used to encrypt job outputs at rest. If empty, a random key is used and outputs are unreadable after a restart
+	EncryptionKey []byte
+	// How long to keep job outputs. 0 means forever
+	OutputRetention time.Duration
+}
+
+// Finished returns true if the job is not queued or running
+func (j Job) Finished() bool {
+	return j.Status != StatusQueued && j.Status != StatusRunning
+}
+
+// DoneFunc is called once a job has finished with the full output of the command.
+// It runs on its own goroutine so that slow callbacks (e.g flushing streamed output) do not hold up a worker
+type DoneFunc func(j Job, output string, err error)
+
+type task struct {
+	job    Job
+	cmd    auth.Command
+	onLine func(string)
+	done   DoneFunc
+}
+
+// Queue executes submitted commands on a fixed number of workers
+type Queue struct {
+	// serializes read-modify-write of job records
+	mu        sync.Mutex
+	store     storage.Store
+	tasks     chan task
+	cipher    *outputCipher
+	retention time.Duration
+}
+
+// NewQueue starts cfg.Workers goroutines executing jobs.
+// Jobs which were queued or running when the process stopped are marked as failed.
+func NewQueue(s storage.Store, cfg Config) (*Queue, error) {
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("at least 1 worker is required, got %d", cfg.Workers)
+	}
+	key := cfg.EncryptionKey
+	if len(key) == 0 {
+		glog.Warningf("no job output encryption key set, using a random one. Outputs of past jobs will be unreadable after a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "failed to generate job output encryption key")
+		}
+	}
+	c, err := newOutputCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{store: s, tasks: make(chan task, maxQueuedJobs), cipher: c, retention: cfg.OutputRetention}
+	if err := q.failInterrupted(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go q.work()
+	}
+	return q, nil
+}
+
+// Submit queues cmd for execution with input and the named input fields (may be nil).
+// onLine (may be nil) receives output as it is produced and done is called once the job has finished.
+func (q *Queue) Submit(cmd auth.Command, input string, fields map[string]string, requester auth.User, approver *auth.User, onLine func(string), done DoneFunc) (Job, error) {
+	j := Job{
+		ID:        newJobID(),
+		CmdID:     cmd.ID,
+		CmdName:   cmd.PrettyName,
+		Input:     input,
+		Fields:    fields,
+		Status:    StatusQueued,
+		Requester: auth.User{ID: requester.ID, Name: requester.Name},
+		QueuedAt:  time.Now(),
+	}
+	if approver != nil {
+		j.Approver = &auth.User{ID: approver.ID, Name: approver.Name}
+	}
+	if err := q.save(j); err != nil {
+		return Job{}, err
+	}
+	select {
+	case q.tasks <- task{job: j, cmd: cmd, onLine: onLine, done: done}:
+	default:
+		j.Status = StatusFailed
+		j.EndedAt = time.Now()
+		j.Output = "too many queued jobs"
+		q.save(j)
+		return Job{}, fmt.Errorf("job queue is full (%d jobs waiting)", maxQueuedJobs)
+	}
+	glog.Infof("queued job %s: '%s' for user %s", j.ID, j.CmdName, j.Requester.ID)
+	return j, nil
+}
+
+// Get returns the job with the given id, including its decrypted output
+func (q *Queue) Get(id string) (Job, bool, error) {
+	var j Job
+	found, err := q.store.Get(jobsBucket, id, &j)
+	if err != nil {
+		return Job{}, false, errors.Wrapf(err, "failed to get job %s", id)
+	}
+	if found && len(j.EncryptedOutput) > 0 {
+		if j.Output, err = q.cipher.decrypt(j.ID, j.EncryptedOutput); err != nil {
+			return Job{}, false, errors.Wrapf(err, "failed to read output of job %s", id)
+		}
+	}
+	return j, found, nil
+}
+
+// PruneOutputs deletes the outputs of jobs which ended more than the retention period before now
+func (q *Queue) PruneOutputs(now time.Time) error {
+	if q.retention <= 0 {
+		return nil
+	}
+	ids, err := q.store.Keys(jobsBucket)
+	if err != nil {
+		return errors.Wrap(err, "failed to list jobs")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		var j Job
+		if found, err := q.store.Get(jobsBucket, id, &j); err != nil || !found {
+			continue
+		}
+		if !j.Finished() || j.OutputPruned || now.Sub(j.EndedAt) < q.retention {
+			continue
+		}
+		j.EncryptedOutput = nil
+		j.OutputPruned = true
+		if err := q.store.Put(jobsBucket, j.ID, j); err != nil {
+			return errors.Wrapf(err, "failed to prune output of job %s", j.ID)
+		}
+		glog.Infof("pruned output of job %s which ended %s", j.ID, j.EndedAt)
+	}
+	return nil
+}
+
+// ForUser returns the last limit jobs requested by userID, newest first. Outputs are not included
+func (q *Queue) ForUser(userID string, limit int) ([]Job, error) {
+	all, err := q.all()
+	if err != nil {
+		return nil, err
+	}
+	res := []Job{}
+	for _, j := range all {
+		if j.Requester.ID == userID {
+			res = append(res, j)
+		}
+	}
+	sort.Slice(res, func(i, k int) bool {
+		return res[i].QueuedAt.After(res[k].QueuedAt)
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (q *Queue) work() {
+	for t := range q.tasks {
+		q.run(t)
+	}
+}
+
+func (q *Queue) run(t task) {
+	j := t.job
+	j.Status = StatusRunning
+	j.StartedAt = time.Now()
+	if err := q.save(j); err != nil {
+		glog.Errorf("failed to mark job %s as running: %s", j.ID, err.Error())
+	}
+
+	output, err := executor.ExecuteStream(t.cmd, j.Input, j.Fields, t.onLine)
+
+	j.EndedAt = time.Now()
+	switch err.(type) {
+	case nil:
+		j.Status = StatusSucceeded
+		j.Output = output
+	case *executor.TimeoutError:
+		j.Status = StatusTimeout
+		j.Output = output
+	default:
+		j.Status = StatusFailed
+		j.Output = err.Error()
+	}
+	if len(j.Output) > maxStoredOutput {
+		j.Output = truncateOutput(j.Output, maxStoredOutput) + "\n[truncated]"
+	}
+	if saveErr := q.save(j); saveErr != nil {
+		glog.Errorf("failed to save result of job %s: %s", j.ID, saveErr.Error())
+	}
+	glog.Infof("job %s finished with status %s after %s", j.ID, j.Status, j.EndedAt.Sub(j.StartedAt))
+	if t.done != nil {
+		go t.done(j, output, err)
+	}
+}
+
+// truncateOutput returns at most max bytes of output without splitting a UTF-8 character
+func truncateOutput(output string, max int) string {
+	if len(output) <= max {
+		return output
+	}
+	for max > 0 && !utf8.RuneStart(output[max]) {
+		max--
+	}
+	return output[:max]
+}
+
+func (q *Queue) save(j Job) error {
+	j.EncryptedOutput = nil
+	if j.Output != "" {
+		encrypted, err := q.cipher.encrypt(j.ID, j.Output)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encrypt output of job %s", j.ID)
+		}
+		j.EncryptedOutput = encrypted
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.store.Put(jobsBucket, j.ID, j); err != nil {
+		return errors.Wrapf(err, "failed to save job %s", j.ID)
+	}
+	return nil
+}
+
+func (q *Queue) all() ([]Job, error) {
+	ids, err := q.store.Keys(jobsBucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list jobs")
+	}
+	res := []Job{}
+	for _, id := range ids {
+		// outputs are not decrypted, use Get for that
+		var j Job
+		found, err := q.store.Get(jobsBucket, id, &j)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get job %s", id)
+		}
+		if found {
+			res = append(res, j)
+		}
+	}
+	return res, nil
+}
+
+func (q *Queue) failInterrupted() error {
+	all, err := q.all()
+	if err != nil {
+		return err
+	}
+	for _, j := range all {
+		if j.Finished() {
+			continue
+		}
+		glog.Warningf("job %s was %s when the process stopped, marking it as failed", j.ID, j.Status)
+		j.Status = StatusFailed
+		j.EndedAt = time.Now()
+		j.Output = "interrupted by a restart"
+		if err := q.save(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newJobID returns a short id users can type
+func newJobID() string {
+	return uuid.New().String()[:8]
+}
@@ -0,0 +1,157 @@
+package jobs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+)
+
+func newTestQueue(t *testing.T, cfg Config) *Queue {
+	store, err := storage.NewFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestQueueWithStore(t, store, cfg)
+}
+
+func newTestQueueWithStore(t *testing.T, store storage.Store, cfg Config) *Queue {
+	if cfg.EncryptionKey == nil {
+		cfg.EncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	}
+	q, err := NewQueue(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// waitDone returns a DoneFunc and a channel receiving the jobs it is called with
+func waitDone() (DoneFunc, chan Job) {
+	ch := make(chan Job, 1)
+	return func(j Job, output string, err error) { ch <- j }, ch
+}
+
+func receive(t *testing.T, ch chan Job) Job {
+	select {
+	case j := <-ch:
+		return j
+	case <-time.After(10 * time.Second):
+		t.Fatal("job did not finish")
+		return Job{}
+	}
+}
+
+// A slow done callback does not keep the only worker from running the next job
+func TestSlowDoneDoesNotBlockWorker(t *testing.T) {
+	q := newTestQueue(t, Config{Workers: 1})
+	release := make(chan struct{})
+	defer close(release)
+	firstDone := make(chan Job, 1)
+	_, err := q.Submit(auth.Command{CMD: "echo first"}, "x", nil, auth.User{ID: "u"}, nil, nil, func(j Job, output string, err error) {
+		firstDone <- j
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, firstDone)
+
+	done, secondDone := waitDone()
+	if _, err := q.Submit(auth.Command{CMD: "echo second"}, "x", nil, auth.User{ID: "u"}, nil, nil, done); err != nil {
+		t.Fatal(err)
+	}
+	if j := receive(t, secondDone); j.Status != StatusSucceeded {
+		t.Fatalf("second job %s", j.Status)
+	}
+}
+
+// run submits cmd and returns the job once it has finished
+func run(t *testing.T, q *Queue, cmd string) Job {
+	done, ch := waitDone()
+	if _, err := q.Submit(auth.Command{CMD: cmd}, "x", nil, auth.User{ID: "u"}, nil, nil, done); err != nil {
+		t.Fatal(err)
+	}
+	return receive(t, ch)
+}
+
+func TestOutputIsEncryptedAtRest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	store, err := storage.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := run(t, newTestQueueWithStore(t, store, Config{Workers: 1}), "echo top-secret-output")
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("top-secret-output")) {
+		t.Fatalf("output is stored in plain text: %s", raw)
+	}
+
+	store, err = storage.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := newTestQueueWithStore(t, store, Config{Workers: 1}).Get(j.ID)
+	if err != nil || !found || !strings.Contains(got.Output, "top-secret-output") {
+		t.Fatalf("got %+v %v %v after a restart", got, found, err)
+	}
+	otherKey := Config{Workers: 1, EncryptionKey: []byte("fedcba9876543210fedcba9876543210")}
+	if got, _, err := newTestQueueWithStore(t, store, otherKey).Get(j.ID); err == nil {
+		t.Fatalf("read output %q with another key", got.Output)
+	}
+}
+
+func TestPruneOutputs(t *testing.T) {
+	q := newTestQueue(t, Config{Workers: 1, OutputRetention: time.Hour})
+	j := run(t, q, "echo done")
+
+	if err := q.PruneOutputs(j.EndedAt.Add(59 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := q.Get(j.ID); got.OutputPruned || !strings.Contains(got.Output, "done") {
+		t.Fatalf("output was pruned before the retention period: %+v", got)
+	}
+	if err := q.PruneOutputs(j.EndedAt.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := q.Get(j.ID)
+	if err != nil || !found || !got.OutputPruned || got.Output != "" || len(got.EncryptedOutput) != 0 {
+		t.Fatalf("got %+v %v %v after the retention period", got, found, err)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		max    int
+		want   string
+	}{
+		{output: "short", max: 10, want: "short"},
+		{output: "abcdef", max: 3, want: "abc"},
+		// "é" is 2 bytes and would be split
+		{output: "abé", max: 3, want: "ab"},
+		{output: "ab€", max: 4, want: "ab"},
+		{output: "ab€", max: 5, want: "ab€"},
+		{output: "€", max: 2, want: ""},
+	}
+	for _, tt := range tests {
+		if got := truncateOutput(tt.output, tt.max); got != tt.want {
+			t.Errorf("truncateOutput(%q, %d) = %q, want %q", tt.output, tt.max, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Package oidc is a minimal OpenID Connect relying party: authorization code flow with PKCE and RS256 ID tokens
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUsernameClaim = "preferred_username"
+	defaultGroupsClaim   = "groups"
+
+	// Tolerated clock difference between us and the issuer
+	clockSkew = time.Minute
+)
+
+// Config of the OIDC client registered at the issuer
+type Config struct {
+	// e.g https://authentik.example.com/application/o/chatbot/
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// Where the issuer sends the user back to after logging in
+	RedirectURL string
+	// ID token claims holding the username and the list of groups. Default to preferred_username and groups
+	UsernameClaim string
+	GroupsClaim   string
+}
+
+// Claims are the parts of a verified ID token the chatbot uses
+type Claims struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// Provider talks to the issuer. Its endpoints are discovered on first use
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	// RSA keys by kid
+	keys map[string]*rsa.PublicKey
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(config Config) (*Provider, error) {
+	if config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.Errorf("issuer URL, client ID and redirect URL are required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = defaultUsernameClaim
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = defaultGroupsClaim
+	}
+	return &Provider{config: config, client: &http.Client{Timeout: 10 * time.Second}, keys: map[string]*rsa.PublicKey{}}, nil
+}
+
+// RandomString returns a URL safe random string for state, nonce and PKCE verifier values
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "failed to read random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the issuer's login URL. codeVerifier is sent hashed (PKCE S256) and must be passed to Exchange
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems code at the token endpoint and returns the claims of the verified ID token
+func (p *Provider) Exchange(code, codeVerifier, nonce string) (Claims, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return Claims{}, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, errors.Wrapf(err, "failed to create token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJSON(req, &token); err != nil {
+		return Claims{}, errors.Wrapf(err, "failed to redeem authorization code")
+	}
+	if token.IDToken == "" {
+		return Claims{}, errors.Errorf("token response has no id_token")
+	}
+	return p.verify(token.IDToken, nonce)
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *Provider) verify(idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, errors.Wrapf(err, "invalid ID token header")
+	}
+	if header.Alg != "RS256" {
+		return Claims{}, errors.Errorf("unsupported ID token algorithm '%s', configure the issuer to sign with RS256", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, errors.Wrapf(err, "invalid ID token signature encoding")
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return Claims{}, errors.Wrapf(err, "invalid ID token signature")
+	}
+
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return Claims{}, errors.Wrapf(err, "invalid ID token payload")
+	}
+	d, err := p.getDiscovery()
+	if err != nil {
+		return Claims{}, err
+	}
+	if iss, _ := raw["iss"].(string); iss != d.Issuer {
+		return Claims{}, errors.Errorf("ID token issued by '%s', expected '%s'", iss, d.Issuer)
+	}
+	if !containsAudience(raw["aud"], p.config.ClientID) {
+		return Claims{}, errors.Errorf("ID token is not meant for client '%s'", p.config.ClientID)
+	}
+	exp, _ := raw["exp"].(float64)
+	if time.Now().Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return Claims{}, errors.Errorf("ID token has expired")
+	}
+	if n, _ := raw["nonce"].(string); n != nonce {
+		return Claims{}, errors.Errorf("ID token nonce does not match")
+	}
+
+	c := Claims{}
+	c.Subject, _ = raw["sub"].(string)
+	c.Username, _ = raw[p.config.UsernameClaim].(string)
+	c.Email, _ = raw["email"].(string)
+	if groups, ok := raw[p.config.GroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				c.Groups = append(c.Groups, s)
+			}
+		}
+	}
+	if c.Subject == "" || c.Username == "" {
+		return Claims{}, errors.Errorf("ID token has no sub or %s claim", p.config.UsernameClaim)
+	}
+	return c, nil
+}
+
+func containsAudience(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Provider) getDiscovery() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.config.IssuerURL, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create discovery request")
+	}
+	d := &discovery{}
+	if err := p.doJSON(req, d); err != nil {
+		return nil, errors.Wrapf(err, "failed to discover OIDC endpoints of %s", p.config.IssuerURL)
+	}
+	// OpenID Connect Discovery 4.3, otherwise another issuer could hand out tokens we accept
+	if d.Issuer != p.config.IssuerURL {
+		return nil, errors.Errorf("OIDC discovery document of %s is for issuer '%s', the issuer URL must match it exactly", p.config.IssuerURL, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.Errorf("OIDC discovery document of %s is missing endpoints", p.config.IssuerURL)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key returns the issuer's key with id kid. Keys are fetched again if kid is unknown, in case they were rotated
+func (p *Provider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create JWKS request")
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.doJSON(req, &jwks); err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch signing keys")
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+	k, ok := keys[kid]
+	if !ok {
+		return nil, errors.Errorf("issuer has no RSA key '%s'", kid)
+	}
+	return k, nil
+}
+
+func (p *Provider) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read response of %s", req.URL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned %s: %s", req.URL, resp.Status, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrapf(err, "failed to decode response of %s", req.URL)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,123 @@
+package oidc
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	issuer, err := oidctest.NewIssuer("chatbot", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	issuer.SetUser(map[string]interface{}{"sub": "1234", "preferred_username": "viktor", "groups": []string{"viktor", "other"}})
+	p, err := NewProvider(Config{IssuerURL: issuer.URL, ClientID: issuer.ClientID, ClientSecret: issuer.ClientSecret, RedirectURL: "https://bot.example.com/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, issuer
+}
+
+func TestVerify(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	otherKey, err := issuer.SignWithOtherKey(issuer.Claims("nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(k string, v interface{}) string {
+		claims := issuer.Claims("nonce")
+		claims[k] = v
+		return issuer.Sign(claims)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "valid", token: issuer.Sign(issuer.Claims("nonce"))},
+		{name: "audience list", token: with("aud", []string{"other", "chatbot"})},
+		{name: "bad signature", token: otherKey, wantErr: "invalid ID token signature"},
+		{name: "tampered payload", token: strings.Replace(issuer.Sign(issuer.Claims("nonce")), ".", ".e30", 1), wantErr: "invalid ID token signature"},
+		{name: "wrong issuer", token: with("iss", "https://evil.example.com"), wantErr: "ID token issued by"},
+		{name: "wrong audience", token: with("aud", "other"), wantErr: "not meant for client"},
+		{name: "expired", token: with("exp", time.Now().Add(-2*clockSkew).Unix()), wantErr: "expired"},
+		{name: "nonce mismatch", token: with("nonce", "other"), wantErr: "nonce does not match"},
+		{name: "no username", token: with("preferred_username", nil), wantErr: "no sub or preferred_username"},
+		{name: "malformed", token: "not-a-jwt", wantErr: "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.verify(tt.token, "nonce")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want '%s'", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "1234" || claims.Username != "viktor" || strings.Join(claims.Groups, ",") != "viktor,other" {
+				t.Fatalf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p, _ := newTestProvider(t)
+	// the fake issuer's authorization endpoint logs in without asking
+	loginURL, err := p.AuthCodeURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, loginURL)
+
+	if _, err := p.Exchange(code, "other-verifier", "nonce"); err == nil {
+		t.Fatal("exchanged a code with the wrong PKCE verifier")
+	}
+	code = authorize(t, loginURL)
+	claims, err := p.Exchange(code, "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "viktor" {
+		t.Fatalf("got claims %+v", claims)
+	}
+	if _, err := p.Exchange(code, "verifier", "nonce"); err == nil {
+		t.Fatal("redeemed a code twice")
+	}
+}
+
+func TestDiscoveryIssuerMustMatch(t *testing.T) {
+	_, issuer := newTestProvider(t)
+	p, err := NewProvider(Config{IssuerURL: issuer.URL + "/", ClientID: issuer.ClientID, RedirectURL: "https://bot.example.com/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AuthCodeURL("state", "nonce", "verifier"); err == nil || !strings.Contains(err.Error(), "must match it exactly") {
+		t.Fatalf("got error %v for a discovery document of another issuer", err)
+	}
+}
+
+// authorize follows loginURL and returns the code the issuer redirects back with
+func authorize(t *testing.T, loginURL string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || back.Query().Get("code") == "" || back.Query().Get("state") != "state" {
+		t.Fatalf("got redirect '%s' from the login page: %v", resp.Header.Get("Location"), err)
+	}
+	return back.Query().Get("code")
+}
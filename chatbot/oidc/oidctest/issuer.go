@@ -0,0 +1,211 @@
+// Package oidctest provides a fake OpenID Connect issuer for tests of the account linking flow
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// KeyID is the kid of the key the issuer signs ID tokens with
+const KeyID = "oidctest"
+
+// Issuer serves discovery, JWKS, authorization and token endpoints. Every authorization request
+// logs in the user set with SetUser without asking and redirects back with a code which can be redeemed once
+type Issuer struct {
+	Server *httptest.Server
+	// Issuer URL, the same as Server.URL
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	mu sync.Mutex
+	// Claims of the user who logs in next e.g sub, preferred_username and groups
+	user map[string]interface{}
+	// How long issued ID tokens are valid for
+	tokenLifetime time.Duration
+	key           *rsa.PrivateKey
+	codes         map[string]authRequest
+}
+
+type authRequest struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// NewIssuer starts an issuer which accepts the given client. Close it when done
+func NewIssuer(clientID, clientSecret string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	i := &Issuer{
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		user:          map[string]interface{}{},
+		tokenLifetime: 5 * time.Minute,
+		key:           key,
+		codes:         map[string]authRequest{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	i.Server = httptest.NewServer(mux)
+	i.URL = i.Server.URL
+	return i, nil
+}
+
+func (i *Issuer) Close() {
+	i.Server.Close()
+}
+
+// SetUser sets the claims of the user who logs in next
+func (i *Issuer) SetUser(claims map[string]interface{}) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.user = claims
+}
+
+// SetTokenLifetime sets how long ID tokens issued from now on are valid for. Negative values issue expired tokens
+func (i *Issuer) SetTokenLifetime(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tokenLifetime = d
+}
+
+// Claims returns the claims the issuer puts in an ID token for the current user and nonce
+func (i *Issuer) Claims(nonce string) map[string]interface{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   i.URL,
+		"aud":   i.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(i.tokenLifetime).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range i.user {
+		claims[k] = v
+	}
+	return claims
+}
+
+// Sign returns an RS256 ID token with the given claims signed by the issuer's key
+func (i *Issuer) Sign(claims map[string]interface{}) string {
+	return sign(i.key, claims)
+}
+
+// SignWithOtherKey returns an ID token claiming to come from the issuer's key but signed by another one
+func (i *Issuer) SignWithOtherKey(claims map[string]interface{}) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	return sign(key, claims), nil
+}
+
+func sign(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": KeyID})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + encode(sig)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": KeyID,
+			"n":   encode(i.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != i.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := encode(b)
+	i.mu.Lock()
+	i.codes[code] = authRequest{redirectURI: redirect.String(), nonce: q.Get("nonce"), codeChallenge: q.Get("code_challenge")}
+	i.mu.Unlock()
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != i.ClientID || secret != i.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	i.mu.Lock()
+	req, ok := i.codes[r.Form.Get("code")]
+	delete(i.codes, r.Form.Get("code"))
+	i.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || req.redirectURI != r.Form.Get("redirect_uri") || encode(challenge[:]) != req.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "oidctest",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     i.Sign(i.Claims(req.nonce)),
+	})
+}
@@ -0,0 +1,142 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+)
+
+const (
+	// Minimum time between 2 progress messages to the same user
+	progressInterval = 5 * time.Second
+	// Messenger rejects text messages longer than 2000 characters
+	maxProgressMessageLen = 1900
+	// Lines waiting to be sent beyond this are dropped, oldest first
+	maxQueuedProgressLines = 200
+)
+
+// progressReporter batches lines of command output and sends them to a user at most once per progressInterval.
+// Output produced faster than it can be sent is skipped and only counted.
+type progressReporter struct {
+	recipient string
+	mu        sync.Mutex
+	lines     []string
+	total     int
+	// lines which were never sent
+	skipped int
+	// lines dropped since the last batch, reported at the start of the next one
+	unreported int
+	lastSent   time.Time
+	done       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+func newProgressReporter(recipient string) *progressReporter {
+	p := &progressReporter{recipient: recipient, done: make(chan struct{})}
+	p.stopped.Add(1)
+	go p.loop()
+	return p
+}
+
+// Add queues a line of output to be sent with the next batch
+func (p *progressReporter) Add(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total++
+	if len(p.lines) >= maxQueuedProgressLines {
+		p.lines = p.lines[1:]
+		p.skipped++
+		p.unreported++
+	}
+	p.lines = append(p.lines, line)
+}
+
+// Close sends one last batch once the interval allows it and returns the number of lines produced
+// and how many of them were not sent. Those are left to the summary.
+func (p *progressReporter) Close() (int, int) {
+	close(p.done)
+	p.stopped.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total, p.skipped
+}
+
+func (p *progressReporter) loop() {
+	defer p.stopped.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flush()
+		case <-p.done:
+			p.mu.Lock()
+			wait := progressInterval - time.Since(p.lastSent)
+			pending := len(p.lines) > 0
+			p.mu.Unlock()
+			if pending && wait > 0 {
+				time.Sleep(wait)
+			}
+			p.flush()
+			p.mu.Lock()
+			p.skipped += len(p.lines)
+			p.lines = nil
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// flush sends the next batch of lines
+func (p *progressReporter) flush() {
+	msg := p.nextBatch()
+	if msg == "" {
+		return
+	}
+	if err := fbapi.SendRawMessage(p.recipient, msg); err != nil {
+		glog.Warningf("failed to send progress to %s: %s", p.recipient, err.Error())
+	}
+}
+
+// nextBatch takes as many queued lines as fit in a single message
+func (p *progressReporter) nextBatch() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	batch := []string{}
+	size := 0
+	if p.unreported > 0 && len(p.lines) > 0 {
+		notice := fmt.Sprintf("[%d lines skipped]", p.unreported)
+		batch = append(batch, notice)
+		size += len(notice) + 1
+		p.unreported = 0
+	}
+	for len(p.lines) > 0 {
+		line := truncateUTF8(p.lines[0], maxProgressMessageLen)
+		if size+len(line)+1 > maxProgressMessageLen && len(batch) > 0 {
+			break
+		}
+		batch = append(batch, line)
+		size += len(line) + 1
+		p.lines = p.lines[1:]
+	}
+	if len(batch) > 0 {
+		p.lastSent = time.Now()
+	}
+	return strings.Join(batch, "\n")
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
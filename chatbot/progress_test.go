@@ -0,0 +1,43 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestProgressReporterDropsBacklog(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	p := newProgressReporter("psid-1")
+	for i := 0; i < 1000; i++ {
+		p.Add(fmt.Sprintf("line %d", i))
+	}
+	total, skipped := p.Close()
+
+	sent := sendAPI.to("psid-1")
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages, want a single last batch", len(sent))
+	}
+	if !strings.HasPrefix(sent[0].Text, fmt.Sprintf("[%d lines skipped]\nline %d\n", 1000-maxQueuedProgressLines, 1000-maxQueuedProgressLines)) {
+		t.Errorf("batch does not start with the skipped notice: %q", sent[0].Text[:50])
+	}
+	if len(sent[0].Text) > maxProgressMessageLen {
+		t.Errorf("batch is %d bytes long", len(sent[0].Text))
+	}
+	sentLines := strings.Count(sent[0].Text, "\n")
+	if total != 1000 || skipped != total-sentLines {
+		t.Errorf("got %d lines, %d skipped, %d sent", total, skipped, sentLines)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	s := strings.Repeat("я", maxProgressMessageLen)
+	got := truncateUTF8(s, maxProgressMessageLen+1)
+	if !utf8.ValidString(got) || len(got) != maxProgressMessageLen {
+		t.Errorf("got %d bytes, valid: %t", len(got), utf8.ValidString(got))
+	}
+	if truncateUTF8("abc", 5) != "abc" {
+		t.Error("short strings must not change")
+	}
+}
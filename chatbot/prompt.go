@@ -0,0 +1,199 @@
+package chatbot
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+)
+
+/* Prompts are follow-up questions which are not part of the FSM config.
+While a prompt is pending, the prompt's own buttons and, for prompts answered with text, free text are passed
+to the prompt handler instead of moving the FSM. Anything else cancels the prompt and moves the FSM as usual. */
+
+const (
+	promptRejectionReason = "rejection_reason"
+	promptConfirmInput    = "confirm_input"
+
+	// Payload of the button which answers a prompt with nothing
+	skipPromptPayload = "SkipPrompt"
+	// Payloads of the buttons answering a confirm_input prompt. Edit discards the input so it can be entered again
+	confirmInputPayload = "ConfirmInput"
+	editInputPayload    = "EditInput"
+)
+
+// promptHandler processes the answer to a prompt and returns a message for the user
+type promptHandler func(c *ChatbotHandler, user auth.User, p storage.Prompt, answer string) (string, error)
+
+var promptHandlers = map[string]promptHandler{
+	promptRejectionReason: answerRejectionReason,
+	promptConfirmInput:    answerConfirmInput,
+}
+
+// promptButtons are the payloads of the buttons sent along with each kind of prompt
+var promptButtons = map[string][]string{
+	promptRejectionReason: {skipPromptPayload},
+	promptConfirmInput:    {confirmInputPayload, editInputPayload},
+}
+
+// promptsAnsweredWithText are the kinds of prompts which take free text besides their buttons
+var promptsAnsweredWithText = map[string]bool{
+	promptRejectionReason: true,
+}
+
+// answersPrompt returns true if payload is an answer to p rather than a message meant to move the FSM.
+// Buttons of the prompt answer it, so does free text if the prompt takes it. Events of the config and other buttons do not
+func answersPrompt(f *statemachine.FSMWithStatesAndEvents, p storage.Prompt, payload string, postback bool) bool {
+	for _, b := range promptButtons[p.Kind] {
+		if payload == b {
+			return true
+		}
+	}
+	return promptsAnsweredWithText[p.Kind] && !postback && !f.HasEvent(payload)
+}
+
+// askPrompt sends question with a Skip button to userid and records that their next message answers it
+func (c *ChatbotHandler) askPrompt(userid string, p storage.Prompt, question string) error {
+	if err := c.setPrompt(userid, &p); err != nil {
+		return err
+	}
+	buttons := eventsToPostbackButtons([]statemachine.Event{{Name: skipPromptPayload, Message: "Skip"}})
+	elements := getPostbackElements(question, "Reply with a message or tap Skip", buttons)
+	return fbapi.SendPostBackMessage(userid, getPostbackPayload(userid, elements))
+}
+
+// cancelPrompt drops the pending prompt of userid along with the input it was asking to confirm, if any
+func (c *ChatbotHandler) cancelPrompt(userid string) error {
+	conv, _, err := c.Conversations.Load(userid)
+	if err != nil {
+		return err
+	}
+	if conv.Prompt != nil && conv.Prompt.Kind == promptConfirmInput {
+		conv.PendingInput = ""
+		conv.Fields = nil
+	}
+	conv.Prompt = nil
+	return c.Conversations.Save(userid, conv)
+}
+
+func (c *ChatbotHandler) setPrompt(userid string, p *storage.Prompt) error {
+	conv, _, err := c.Conversations.Load(userid)
+	if err != nil {
+		return err
+	}
+	conv.Prompt = p
+	return c.Conversations.Save(userid, conv)
+}
+
+func (c *ChatbotHandler) processPromptAnswer(user auth.User, p storage.Prompt, answer string, moveFSMResult MoveFSMResult) error {
+	if err := c.setPrompt(user.ID, nil); err != nil {
+		return errors.Wrapf(err, "failed to clear prompt")
+	}
+	if answer == skipPromptPayload {
+		answer = ""
+	}
+	handler, ok := promptHandlers[p.Kind]
+	if !ok {
+		glog.Warningf("no handler for prompt kind '%s', dropping answer of user %s", p.Kind, user.ID)
+		return respondToUser(user.ID, moveFSMResult)
+	}
+	msg, err := handler(c, user, p, answer)
+	if err != nil {
+		moveFSMResult.AdditionalMsg = fmt.Sprintf("Failed to process your answer: %s", err.Error())
+		respondToUser(user.ID, moveFSMResult)
+		return errors.Wrapf(err, "failed to process answer to '%s' prompt", p.Kind)
+	}
+	moveFSMResult.AdditionalMsg = msg
+	return respondToUser(user.ID, moveFSMResult)
+}
+
+// answerRejectionReason forwards the moderator's reason for rejecting a request to the requester and the other moderators
+func answerRejectionReason(c *ChatbotHandler, moderator auth.User, p storage.Prompt, reason string) (string, error) {
+	if reason == "" {
+		return "No reason will be sent.", nil
+	}
+	req, found, err := c.Approvals.Request(p.Ref)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("approval request %s no longer exists", p.Ref)
+	}
+	what, err := c.cmdFromId(req.CmdID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.Approvals.SetReason(req.ID, reason); err != nil {
+		return "", err
+	}
+	if err := fbapi.SendRawMessage(req.From.ID, fmt.Sprintf("%s rejected your request to %s. Reason: %s", moderator.Name, req.Summary(what), reason)); err != nil {
+		return "", errors.Wrapf(err, "failed to send rejection reason to %s", req.From.ID)
+	}
+	c.notifyOtherApprovers(req, what, moderator, fmt.Sprintf("%s gave the following reason for rejecting the request of '%s' to %s: %s", moderator.Name, req.From.Name, req.Summary(what), reason))
+	return fmt.Sprintf("Sent your reason to %s.", req.From.Name), nil
+}
+
+// askToConfirmInput keeps input and fields until the user confirms them and shows Confirm and Edit buttons
+func (c *ChatbotHandler) askToConfirmInput(user auth.User, state statemachine.State, input string, fields map[string]string, moveFSMResult *MoveFSMResult) error {
+	conv, _, err := c.Conversations.Load(user.ID)
+	if err != nil {
+		return err
+	}
+	conv.PendingInput = input
+	conv.Fields = fields
+	conv.Prompt = &storage.Prompt{Kind: promptConfirmInput, Ref: state.Name}
+	if err := c.Conversations.Save(user.ID, conv); err != nil {
+		return err
+	}
+	details := fmt.Sprintf("input: '%s'", input)
+	if len(fields) > 0 {
+		details = formatFields(fields)
+	}
+	moveFSMResult.CmdOutput = fmt.Sprintf("Please confirm you want to run '%s' with\n%s", state.DefaultHandler.PrettyName, details)
+	moveFSMResult.Buttons = []statemachine.Event{{Name: confirmInputPayload, Message: "Confirm"}, {Name: editInputPayload, Message: "Edit"}}
+	return nil
+}
+
+// answerConfirmInput runs the default handler with the input the user has confirmed or discards it if they chose to edit it
+func answerConfirmInput(c *ChatbotHandler, user auth.User, p storage.Prompt, answer string) (string, error) {
+	if answer != confirmInputPayload && answer != editInputPayload {
+		return "", fmt.Errorf("'%s' is neither Confirm nor Edit", answer)
+	}
+	conv, _, err := c.Conversations.Load(user.ID)
+	if err != nil {
+		return "", err
+	}
+	input, fields := conv.PendingInput, conv.Fields
+	conv.PendingInput = ""
+	conv.Fields = nil
+	userFsm, err := c.loadFSM(user.ID)
+	if err != nil {
+		return "", err
+	}
+	state := userFsm.Current()
+	if state.Name != p.Ref {
+		// the user was moved e.g by a config change
+		return "", c.Conversations.Save(user.ID, conv)
+	}
+	if answer == editInputPayload {
+		glog.Infof("user %s chose to edit input for '%s', discarding it", user.ID, state.DefaultHandler.PrettyName)
+		if err := c.Conversations.Save(user.ID, conv); err != nil {
+			return "", err
+		}
+		if field, ok := nextInput(state, nil); ok {
+			return "OK, let's start over.\n\n" + field.PromptText(), nil
+		}
+		return "OK, please send your input again.", nil
+	}
+
+	result := MoveFSMResult{FSM: *userFsm}
+	conv.PendingInput = c.runDefaultHandler(user, state, input, fields, true, &result)
+	if err := c.Conversations.Save(user.ID, conv); err != nil {
+		return "", err
+	}
+	return result.CmdOutput + result.AdditionalMsg, nil
+}
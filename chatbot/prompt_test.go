@@ -0,0 +1,190 @@
+package chatbot
+
+import (
+	"testing"
+)
+
+// rejectWithPrompt has the config admin reject a new request of requester, which asks the admin for a reason
+func rejectWithPrompt(t *testing.T, c *ChatbotHandler, requester string) ApprovalRequest {
+	req := requestApproval(t, c, requester, "setup_wireguard", "laptop")
+	postPostback(t, c, testAdminID, signApprovalToken(req.ID, ApprovalStateRejected))
+	conv, _, err := c.Conversations.Load(testAdminID)
+	if err != nil || conv.Prompt == nil || conv.Prompt.Kind != promptRejectionReason {
+		t.Fatalf("moderator was not asked for a reason: %+v %v", conv.Prompt, err)
+	}
+	return req
+}
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		name string
+		// sends the moderator's next message
+		send       func(t *testing.T, c *ChatbotHandler)
+		wantReason string
+		// state of the moderator afterwards
+		wantState string
+	}{
+		{
+			name:       "free text",
+			send:       func(t *testing.T, c *ChatbotHandler) { postMessage(t, c, testAdminID, "not on a Friday") },
+			wantReason: "not on a Friday",
+			wantState:  "Initial",
+		},
+		{
+			name:      "skip",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, testAdminID, skipPromptPayload) },
+			wantState: "Initial",
+		},
+		{
+			name:      "FSM button",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, testAdminID, "GetStarted") },
+			wantState: "Hello",
+		},
+		{
+			name:      "typed FSM event",
+			send:      func(t *testing.T, c *ChatbotHandler) { postMessage(t, c, testAdminID, "GetStarted") },
+			wantState: "Hello",
+		},
+		{
+			name:      "other button",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, testAdminID, "SomeOldButton") },
+			wantState: "Initial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendAPI := stubSendAPI(t)
+			c := newTestHandler(t)
+			const requester = "psid-rejected"
+			req := rejectWithPrompt(t, c, requester)
+
+			tt.send(t, c)
+
+			conv, _, _ := c.Conversations.Load(testAdminID)
+			if conv.Prompt != nil {
+				t.Fatalf("prompt %+v is still pending", conv.Prompt)
+			}
+			if f, _ := c.loadFSM(testAdminID); f.Current().Name != tt.wantState {
+				t.Fatalf("moderator is in '%s', want '%s'", f.Current().Name, tt.wantState)
+			}
+			d, _, _ := c.Approvals.Get(req.ID)
+			if d.Reason != tt.wantReason {
+				t.Fatalf("got reason %q, want %q", d.Reason, tt.wantReason)
+			}
+			sentReasons := countSent(sendAPI, requester, "Reason:")
+			if tt.wantReason == "" && sentReasons != 0 {
+				t.Fatalf("requester got a reason: %+v", sendAPI.to(requester))
+			}
+			if tt.wantReason != "" && countSent(sendAPI, requester, "Reason: "+tt.wantReason) != 1 {
+				t.Fatalf("requester did not get the reason: %+v", sendAPI.to(requester))
+			}
+		})
+	}
+}
+
+func TestRejectionReasonPromptIsPerModerator(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	rejectWithPrompt(t, c, "psid-rejected")
+	// somebody else's messages do not answer the moderator's prompt
+	postMessage(t, c, "psid-rejected", "please")
+	if n := countSent(sendAPI, "psid-rejected", "Reason:"); n != 0 {
+		t.Fatalf("requester answered the moderator's prompt")
+	}
+	if conv, _, _ := c.Conversations.Load(testAdminID); conv.Prompt == nil || conv.Prompt.Kind != promptRejectionReason {
+		t.Fatalf("moderator's prompt was cancelled by another user")
+	}
+}
+
+// enterEmailAlias takes user to the email alias setup and answers its input, which asks them to confirm it
+func enterEmailAlias(t *testing.T, c *ChatbotHandler, user, forwardTo string) {
+	for _, event := range []string{"GetStarted", "Setup", "SetupEmailAlias"} {
+		postPostback(t, c, user, event)
+	}
+	postMessage(t, c, user, forwardTo)
+	conv, _, err := c.Conversations.Load(user)
+	if err != nil || conv.Prompt == nil || conv.Prompt.Kind != promptConfirmInput {
+		t.Fatalf("user was not asked to confirm their input: %+v %v", conv, err)
+	}
+}
+
+func TestConfirmInput(t *testing.T) {
+	const user = "psid-alias"
+	tests := []struct {
+		name string
+		// sends the user's answer to the confirmation
+		send func(t *testing.T, c *ChatbotHandler)
+		// forward_to of the request sent for approval, empty if none must be sent
+		wantRequested string
+		// input pending confirmation afterwards, empty if none
+		wantPending string
+		wantState   string
+	}{
+		{
+			name:          "confirm",
+			send:          func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, user, confirmInputPayload) },
+			wantRequested: "me@example.com",
+			wantState:     "SetupEmailAlias",
+		},
+		{
+			name:      "edit",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, user, editInputPayload) },
+			wantState: "SetupEmailAlias",
+		},
+		{
+			name:        "new value",
+			send:        func(t *testing.T, c *ChatbotHandler) { postMessage(t, c, user, "other@example.com") },
+			wantPending: "other@example.com",
+			wantState:   "SetupEmailAlias",
+		},
+		{
+			name:      "FSM button",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, user, "Back") },
+			wantState: "Setup",
+		},
+		{
+			name:      "typed FSM event",
+			send:      func(t *testing.T, c *ChatbotHandler) { postMessage(t, c, user, "Back") },
+			wantState: "Setup",
+		},
+		{
+			name:      "other button",
+			send:      func(t *testing.T, c *ChatbotHandler) { postPostback(t, c, user, "SomeOldButton") },
+			wantState: "SetupEmailAlias",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubSendAPI(t)
+			c := newTestHandler(t)
+			enterEmailAlias(t, c, user, "me@example.com")
+
+			tt.send(t, c)
+
+			conv, _, _ := c.Conversations.Load(user)
+			if tt.wantPending == "" && (conv.Prompt != nil || len(conv.Fields) != 0) {
+				t.Fatalf("confirmation is still pending: %+v", conv)
+			}
+			// the input of a confirmed request stays pending until it is approved
+			if tt.wantPending == "" && tt.wantRequested != conv.PendingInput {
+				t.Fatalf("got pending input %q, want %q", conv.PendingInput, tt.wantRequested)
+			}
+			if tt.wantPending != "" && (conv.Prompt == nil || conv.Prompt.Kind != promptConfirmInput || conv.Fields["forward_to"] != tt.wantPending) {
+				t.Fatalf("got %+v, want '%s' pending confirmation", conv, tt.wantPending)
+			}
+			if f, _ := c.loadFSM(user); f.Current().Name != tt.wantState {
+				t.Fatalf("user is in '%s', want '%s'", f.Current().Name, tt.wantState)
+			}
+			pending, err := c.Approvals.Pending()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantRequested == "" && len(pending) != 0 {
+				t.Fatalf("unconfirmed input was sent for approval: %+v", pending)
+			}
+			if tt.wantRequested != "" && (len(pending) != 1 || pending[0].Fields["forward_to"] != tt.wantRequested) {
+				t.Fatalf("got requests %+v, want one for '%s'", pending, tt.wantRequested)
+			}
+		})
+	}
+}
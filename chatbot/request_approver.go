@@ -1,9 +1,10 @@
 package chatbot
 
 import (
-	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/uuid"
@@ -13,13 +14,18 @@ import (
 	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
 )
 
-type ApprovalRequestPayload struct {
-	ID    string    `json:"id"`
-	From  auth.User `json:"from"`
-	CmdID string    `json:"cmdID"`
-	// What    auth.Command  `json:"what"`
-	Payload string        `json:"payload"`
-	State   ApprovalState `json:"state"`
+// ApprovalRequest is a request to execute a command on behalf of a user who lacks permission for it.
+// It is kept server side; the moderators' buttons only carry a signed token referring to it.
+type ApprovalRequest struct {
+	ID      string    `json:"id"`
+	From    auth.User `json:"from"`
+	CmdID   string    `json:"cmdID"`
+	Payload string    `json:"payload"`
+	// Named input fields collected from the requester, if the command's state declares inputs
+	Fields    map[string]string `json:"fields,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	// When approvers were last reminded about this request
+	RemindedAt time.Time `json:"remindedAt,omitempty"`
 }
 
 type ApprovalState int
@@ -28,6 +34,7 @@ const (
 	ApprovalStatePending = ApprovalState(iota)
 	ApprovalStateAccepted
 	ApprovalStateRejected
+	ApprovalStateExpired
 )
 
 func (a ApprovalState) String() string {
@@ -36,6 +43,8 @@ func (a ApprovalState) String() string {
 		return "Accepted"
 	case ApprovalStateRejected:
 		return "Rejected"
+	case ApprovalStateExpired:
+		return "Expired"
 	case ApprovalStatePending:
 		return "Pending"
 	default:
@@ -43,14 +52,36 @@ func (a ApprovalState) String() string {
 	}
 }
 
-func isApprovalRequest(payload []byte) bool {
-	var a ApprovalRequestPayload
-	return json.Unmarshal(payload, &a) == nil
+// roleRequestCmdPrefix is the CmdID prefix of approval requests for a role rather than a command e.g "role:admin"
+const roleRequestCmdPrefix = "role:"
+
+// RequestedRole returns the role r asks for if it is a role request
+func (r ApprovalRequest) RequestedRole() (string, bool) {
+	if !strings.HasPrefix(r.CmdID, roleRequestCmdPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(r.CmdID, roleRequestCmdPrefix), true
+}
+
+// Summary describes what r asks for e.g "execute 'Setup VPN' with input 'laptop'"
+func (r ApprovalRequest) Summary(what auth.Command) string {
+	if role, ok := r.RequestedRole(); ok {
+		return fmt.Sprintf("get the '%s' role", role)
+	}
+	return fmt.Sprintf("execute '%s' with input '%s'", what.PrettyName, r.Payload)
 }
 
+func isApprovalRequest(payload string) bool {
+	return strings.HasPrefix(payload, approvalTokenPrefix)
+}
+
+// cmdFromId returns the command with the given id. Role requests get a command whose approvers are the role's
 func (c *ChatbotHandler) cmdFromId(id string) (auth.Command, error) {
+	if strings.HasPrefix(id, roleRequestCmdPrefix) {
+		return c.roleRequestCommand(strings.TrimPrefix(id, roleRequestCmdPrefix))
+	}
 	var res auth.Command
-	for _, cmd := range c.RBACConfig.Commands {
+	for _, cmd := range c.RBAC().Commands {
 		if cmd.ID == id {
 			res = cmd
 		}
@@ -62,21 +93,27 @@ func (c *ChatbotHandler) cmdFromId(id string) (auth.Command, error) {
 }
 
 // send request to all users in the `approvedBy` role
-func (c *ChatbotHandler) sendRequestApprovalRequest(from auth.User, what auth.Command, payload string) error {
-	if len(c.RBACConfig.UsersInRole(what.ApprovedBy)) == 0 {
+func (c *ChatbotHandler) sendRequestApprovalRequest(from auth.User, what auth.Command, payload string, fields map[string]string) error {
+	if len(c.RBAC().UsersInRole(what.ApprovedBy)) == 0 {
 		return fmt.Errorf("no users can approve command '%s': '%s'", what.PrettyName, what.CMD)
 	}
+	req := NewApprovalRequest(from, what, payload, fields)
+	if err := c.Approvals.Save(req); err != nil {
+		return errors.Wrapf(err, "failed to store approval request")
+	}
 	requestMsg := fmt.Sprintf("User '%s'(ID: %s) wants to execute '%s' with input: '%s'", from.Name, from.ID, what.PrettyName, payload)
-
-	acceptPayload, err := serializeApprovalRequest(acceptApprovalRequestPayload(from, what, payload))
-	if err != nil {
-		return errors.Wrapf(err, "failed to get serialized accept payload")
+	if len(fields) > 0 {
+		requestMsg = fmt.Sprintf("User '%s'(ID: %s) wants to execute '%s' with:\n%s", from.Name, from.ID, what.PrettyName, formatFields(fields))
 	}
+	c.notifyApprovers(req, what, requestMsg)
+	return nil
+}
 
-	rejectPayload, err := serializeApprovalRequest(rejectApprovalRequestPayload(from, what, payload))
-	if err != nil {
-		return errors.Wrapf(err, "failed to get serialized reject payload")
-	}
+// notifyApprovers sends msg along with Approve/Deny buttons for req to all users in the `approvedBy` role
+func (c *ChatbotHandler) notifyApprovers(req ApprovalRequest, what auth.Command, requestMsg string) {
+	// Both buttons refer to the same request so that only 1 decision can be made
+	acceptPayload := signApprovalToken(req.ID, ApprovalStateAccepted)
+	rejectPayload := signApprovalToken(req.ID, ApprovalStateRejected)
 
 	// Get accept/reject buttons
 	events := []statemachine.Event{
@@ -92,7 +129,7 @@ func (c *ChatbotHandler) sendRequestApprovalRequest(from auth.User, what auth.Co
 	buttons := eventsToPostbackButtons(events)
 	elements := getPostbackElements("Select action for this request", "Tap to answer", buttons)
 	// send request to all users with this role
-	for _, u := range c.RBACConfig.UsersInRole(what.ApprovedBy) {
+	for _, u := range c.approversRBAC(what).UsersInRole(what.ApprovedBy) {
 		err := fbapi.SendRawMessage(u.ID, requestMsg)
 		if err != nil {
 			glog.Warningf("failed to send auth request for '%+v' to user %+v", what, u)
@@ -103,22 +140,61 @@ func (c *ChatbotHandler) sendRequestApprovalRequest(from auth.User, what auth.Co
 			glog.Warningf("failed to send postback message '%+v' to user '%+v'; Error: %s", payload, u, err.Error())
 		}
 	}
-	return nil
+}
+
+// String returns a human readable tally e.g "Approvals: 1/2 (Viktor)"
+func (t ApprovalTally) String() string {
+	names := []string{}
+	for _, v := range t.Approvals {
+		names = append(names, v.Moderator.Name)
+	}
+	res := fmt.Sprintf("Approvals: %d/%d", len(t.Approvals), t.Required)
+	if len(names) > 0 {
+		res += fmt.Sprintf(" (%s)", strings.Join(names, ", "))
+	}
+	return res
+}
+
+// notifyApproversOfTally tells all users in the `approvedBy` role about moderator's vote on a request which needs multiple approvals
+func (c *ChatbotHandler) notifyApproversOfTally(req ApprovalRequest, what auth.Command, moderator auth.User, state ApprovalState, tally ApprovalTally) {
+	msg := fmt.Sprintf("%s %s the request of '%s'(ID: %s) to %s. %s", moderator.Name, state.String(), req.From.Name, req.From.ID, req.Summary(what), tally.String())
+	if tally.Decision != nil {
+		msg += fmt.Sprintf("\nThe request is now %s.", tally.Decision.State.String())
+	} else {
+		msg += fmt.Sprintf("\nWaiting for %d more approval(s).", tally.Required-len(tally.Approvals))
+	}
+	for _, u := range c.approversRBAC(what).UsersInRole(what.ApprovedBy) {
+		if err := fbapi.SendRawMessage(u.ID, msg); err != nil {
+			glog.Warningf("failed to send approval tally for request %s to user %+v: %s", req.ID, u, err.Error())
+		}
+	}
+}
+
+// notifyOtherApprovers sends msg to all users in the `approvedBy` role except moderator
+func (c *ChatbotHandler) notifyOtherApprovers(req ApprovalRequest, what auth.Command, moderator auth.User, msg string) {
+	for _, u := range c.approversRBAC(what).UsersInRole(what.ApprovedBy) {
+		if u.ID == moderator.ID {
+			continue
+		}
+		if err := fbapi.SendRawMessage(u.ID, msg); err != nil {
+			glog.Warningf("failed to notify user %+v about approval request %s: %s", u, req.ID, err.Error())
+		}
+	}
 }
 
 // SendApprovalRequestUpdateNotification sends notification to the creator of the request for its status
-func (c *ChatbotHandler) SendApprovalRequestUpdateNotification(r ApprovalRequestPayload, moderator auth.User) error {
+func (c *ChatbotHandler) SendApprovalRequestUpdateNotification(r ApprovalRequest, state ApprovalState, moderator auth.User) error {
 	cmd, err := c.cmdFromId(r.CmdID)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get cmd from id")
 	}
-	requestMsg := fmt.Sprintf("Your request to execute '%s' with input '%s' has been %s by %s", cmd.PrettyName, r.Payload, r.State.String(), moderator.Name)
+	requestMsg := fmt.Sprintf("Your request to %s has been %s by %s", r.Summary(cmd), state.String(), moderator.Name)
 
 	if err := fbapi.SendRawMessage(r.From.ID, requestMsg); err != nil {
 		return errors.Wrapf(err, "failed to notify request sender about the status of their request")
 	}
 
-	moderatorMsg := fmt.Sprintf("Successfully notified %s (ID: %s) about your decision on '%s'. Decision outcome: %s", r.From.Name, r.From.ID, cmd.PrettyName, r.State.String())
+	moderatorMsg := fmt.Sprintf("Successfully notified %s (ID: %s) about your decision on '%s'. Decision outcome: %s", r.From.Name, r.From.ID, cmd.PrettyName, state.String())
 	err = fbapi.SendRawMessage(moderator.ID, moderatorMsg)
 	if err != nil {
 		return errors.Wrapf(err, "failed to notify moderator about the success of their request approval/rejection")
@@ -126,32 +202,6 @@ func (c *ChatbotHandler) SendApprovalRequestUpdateNotification(r ApprovalRequest
 	return nil
 }
 
-func serializeApprovalRequest(a ApprovalRequestPayload) (string, error) {
-	serialized, err := json.Marshal(a)
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to serialize approval request: %+v", a)
-	}
-	return string(serialized), nil
-
-}
-
-func NewApprovalRequest(from auth.User, what auth.Command, state ApprovalState, userInput string) ApprovalRequestPayload {
-	return ApprovalRequestPayload{ID: uuid.New().URN(), From: from, CmdID: what.ID, State: state, Payload: userInput}
-}
-
-func DeserializeApprovalRequest(p []byte) (ApprovalRequestPayload, error) {
-	var a ApprovalRequestPayload
-	err := json.Unmarshal(p, &a)
-	if err != nil {
-		return ApprovalRequestPayload{}, errors.Wrapf(err, "failed to deserialize approval request from payload: %s", string(p))
-	}
-	return a, nil
-}
-
-func acceptApprovalRequestPayload(from auth.User, what auth.Command, userInput string) ApprovalRequestPayload {
-	return NewApprovalRequest(from, what, ApprovalStateAccepted, userInput)
-}
-
-func rejectApprovalRequestPayload(from auth.User, what auth.Command, userInput string) ApprovalRequestPayload {
-	return NewApprovalRequest(from, what, ApprovalStateRejected, userInput)
+func NewApprovalRequest(from auth.User, what auth.Command, userInput string, fields map[string]string) ApprovalRequest {
+	return ApprovalRequest{ID: uuid.New().URN(), From: from, CmdID: what.ID, Payload: userInput, Fields: fields, CreatedAt: time.Now()}
 }
@@ -0,0 +1,133 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+/* Users ask for a role with an approval request whose CmdID is roleRequestCmdPrefix followed by the role.
+Once the role's approvedBy role approves it, the user gets a grant which lasts until it is revoked. */
+
+// roleRequestCommand returns the command approval requests for role are handled as
+func (c *ChatbotHandler) roleRequestCommand(role string) (auth.Command, error) {
+	r, ok := c.RBAC().FindRole(role)
+	if !ok {
+		return auth.Command{}, fmt.Errorf("failed to find role %s", role)
+	}
+	if r.ApprovedBy == nil {
+		return auth.Command{}, fmt.Errorf("role '%s' cannot be requested", role)
+	}
+	return auth.Command{ID: roleRequestCmdPrefix + role, PrettyName: fmt.Sprintf("'%s' role", role), ApprovedBy: *r.ApprovedBy}, nil
+}
+
+// approversRBAC returns the RBAC config the approvers of what are looked up in.
+// Approving a role request gives lasting access, so only roles from the config file count for those, not grants
+func (c *ChatbotHandler) approversRBAC(what auth.Command) auth.RBACConfig {
+	rbac := c.RBAC()
+	if strings.HasPrefix(what.ID, roleRequestCmdPrefix) {
+		rbac.Grants = nil
+	}
+	return rbac
+}
+
+// requestableRoles returns the roles user can ask for
+func (c *ChatbotHandler) requestableRoles(user auth.User) []auth.Role {
+	rbac := c.RBAC()
+	res := []auth.Role{}
+	for _, r := range rbac.AllRoles() {
+		if r.ApprovedBy != nil && !rbac.UserHasRole(user, r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// listRequestableRoles shows the roles the user can ask for when entering the request role state
+func listRequestableRoles(c *ChatbotHandler, user auth.User) (string, error) {
+	roles := c.requestableRoles(user)
+	if len(roles) == 0 {
+		return "There are no roles you can request.", nil
+	}
+	lines := []string{}
+	for _, r := range roles {
+		lines = append(lines, fmt.Sprintf("- %s", r.Name))
+	}
+	return fmt.Sprintf("%s\n\nSend me the name of the role you need, optionally followed by why you need it.", strings.Join(lines, "\n")), nil
+}
+
+// requestRole sends a request for the role named in input to the role's approvers. The rest of input is the reason
+func requestRole(c *ChatbotHandler, user auth.User, input string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(input), " ", 2)
+	name := parts[0]
+	reason := ""
+	if len(parts) > 1 {
+		reason = strings.TrimSpace(parts[1])
+	}
+	var role *auth.Role
+	for _, r := range c.requestableRoles(user) {
+		if r.Name == name {
+			role = &r
+			break
+		}
+	}
+	if role == nil {
+		return "", fmt.Errorf("'%s' is not a role you can request", name)
+	}
+	what, err := c.roleRequestCommand(role.Name)
+	if err != nil {
+		return "", err
+	}
+	pending, err := c.Approvals.Pending()
+	if err != nil {
+		glog.Errorf("failed to list pending approval requests: %s", err.Error())
+		return "", fmt.Errorf("Failed to send your request, please try again")
+	}
+	for _, req := range pending {
+		if req.From.ID == user.ID && req.CmdID == what.ID {
+			return "", fmt.Errorf("You have already asked for the '%s' role, please wait for a decision", role.Name)
+		}
+	}
+	if len(c.approversRBAC(what).UsersInRole(what.ApprovedBy)) == 0 {
+		return "", fmt.Errorf("Nobody can approve requests for the '%s' role", role.Name)
+	}
+
+	req := NewApprovalRequest(user, what, reason, nil)
+	if err := c.Approvals.Save(req); err != nil {
+		glog.Errorf("failed to store role request: %s", err.Error())
+		return "", fmt.Errorf("Failed to send your request, please try again")
+	}
+	requestMsg := fmt.Sprintf("User '%s'(ID: %s) asks for the '%s' role", user.Name, user.ID, role.Name)
+	if reason != "" {
+		requestMsg += fmt.Sprintf(" because: '%s'", reason)
+	}
+	c.notifyApprovers(req, what, requestMsg)
+	return fmt.Sprintf("I have asked the '%s' role to review your request for the '%s' role. Please standby...", what.ApprovedBy.Name, role.Name), nil
+}
+
+// grantRequestedRole adds the role of an approved role request to the grants
+func (c *ChatbotHandler) grantRequestedRole(req ApprovalRequest, role string, moderator auth.User) error {
+	g := auth.Grant{
+		ID:        uuid.New().String()[:8],
+		UserID:    req.From.ID,
+		Role:      role,
+		GrantedBy: auth.User{ID: moderator.ID, Name: moderator.Name},
+		GrantedAt: time.Now(),
+	}
+	if err := c.Grants.Save(g); err != nil {
+		return errors.Wrapf(err, "failed to grant role '%s' to %s", role, req.From.ID)
+	}
+	glog.Infof("user %s approved role request %s, granted '%s' to %s (grant %s)", moderator.ID, req.ID, role, req.From.ID, g.ID)
+	msg := fmt.Sprintf("You now have the '%s' role. Commands it allows will run without asking for approval.", role)
+	if err := fbapi.SendRawMessage(req.From.ID, msg); err != nil {
+		glog.Warningf("failed to notify %s about grant %s: %s", req.From.ID, g.ID, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package chatbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+)
+
+const testAdminID = "3804650372987546"
+
+// grantedRoles returns the roles currently granted to userID
+func grantedRoles(t *testing.T, c *ChatbotHandler, userID string) []string {
+	grants, err := c.Grants.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for _, g := range grants {
+		if g.UserID == userID && g.Active(time.Now()) {
+			res = append(res, g.Role)
+		}
+	}
+	return res
+}
+
+func TestRoleRequestsNeedApproversFromConfig(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	const tempAdmin, requester = "psid-temp-admin", "psid-requester"
+	if err := c.Grants.Save(auth.Grant{ID: "temp", UserID: tempAdmin, Role: "admin", GrantedAt: time.Now(), ExpiresAt: time.Now().Add(2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := requestRole(c, c.RBAC().WhoAmI(requester), "friend please"); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := c.Approvals.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("got %d pending requests: %v", len(pending), err)
+	}
+	req := pending[0]
+
+	// admin through a temporary grant
+	postMessage(t, c, tempAdmin, signApprovalToken(req.ID, ApprovalStateAccepted))
+	if roles := grantedRoles(t, c, requester); len(roles) != 0 {
+		t.Fatalf("a temporary admin gave out %v", roles)
+	}
+	// admin through the config file
+	postMessage(t, c, testAdminID, signApprovalToken(req.ID, ApprovalStateAccepted))
+	if roles := grantedRoles(t, c, requester); len(roles) != 1 || roles[0] != "friend" {
+		t.Fatalf("got roles %v after approval", roles)
+	}
+
+	grants, _ := c.Grants.All()
+	id := ""
+	for _, g := range grants {
+		if g.UserID == requester {
+			id = g.ID
+		}
+	}
+	admin := c.RBAC().WhoAmI(testAdminID)
+	// admin does not have friend but approves it
+	if out, err := manageGrants(c, admin, "revoke "+id); err != nil || !strings.Contains(out, "Revoked") {
+		t.Fatalf("admin could not revoke the friend role: %s %v", out, err)
+	}
+	if roles := grantedRoles(t, c, requester); len(roles) != 0 {
+		t.Fatalf("got roles %v after revoking", roles)
+	}
+}
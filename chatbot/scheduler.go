@@ -0,0 +1,98 @@
+package chatbot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+)
+
+const schedulerInterval = time.Minute
+
+// approvalTimeoutModerator is recorded as the decision maker of expired approval requests
+var approvalTimeoutModerator = auth.User{Name: "timeout"}
+
+// StartScheduler runs periodic background tasks (approval expiry, reminders, approval pruning, grant expiry, link expiry, job output retention...) until the process exits
+func (c *ChatbotHandler) StartScheduler() {
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			c.runScheduledTasks(now)
+		}
+	}()
+}
+
+func (c *ChatbotHandler) runScheduledTasks(now time.Time) {
+	c.processPendingApprovals(now)
+	if pruned, err := c.Approvals.Prune(now, decidedApprovalRetention); err != nil {
+		glog.Errorf("failed to prune decided approval requests: %s", err.Error())
+	} else if pruned > 0 {
+		glog.Infof("pruned %d approval requests decided more than %s ago", pruned, decidedApprovalRetention)
+	}
+	c.expireGrants(now)
+	c.expireLinkSessions(now)
+	c.expireIdentities(now)
+	if err := c.Jobs.PruneOutputs(now); err != nil {
+		glog.Errorf("failed to prune job outputs: %s", err.Error())
+	}
+}
+
+// processPendingApprovals expires approval requests older than their command's timeout
+// and reminds approvers about the ones that are still waiting
+func (c *ChatbotHandler) processPendingApprovals(now time.Time) {
+	pending, err := c.Approvals.Pending()
+	if err != nil {
+		glog.Errorf("failed to list pending approval requests: %s", err.Error())
+		return
+	}
+	for _, req := range pending {
+		what, err := c.cmdFromId(req.CmdID)
+		if err != nil {
+			glog.Warningf("pending approval request %s refers to unknown command '%s'", req.ID, req.CmdID)
+			continue
+		}
+		if what.ApprovalTimeout > 0 && now.Sub(req.CreatedAt) >= what.ApprovalTimeout {
+			c.expireApprovalRequest(req, what)
+			continue
+		}
+		if what.ApprovalReminderInterval > 0 {
+			lastReminder := req.CreatedAt
+			if req.RemindedAt.After(lastReminder) {
+				lastReminder = req.RemindedAt
+			}
+			if now.Sub(lastReminder) >= what.ApprovalReminderInterval {
+				c.remindApprovers(req, what, now)
+			}
+		}
+	}
+}
+
+func (c *ChatbotHandler) expireApprovalRequest(req ApprovalRequest, what auth.Command) {
+	_, recorded, err := c.Approvals.Decide(req.ID, ApprovalStateExpired, approvalTimeoutModerator)
+	if err != nil {
+		glog.Errorf("failed to expire approval request %s: %s", req.ID, err.Error())
+		return
+	}
+	if !recorded {
+		// a moderator got there first
+		return
+	}
+	glog.Infof("approval request %s for '%s' by %s expired", req.ID, what.PrettyName, req.From.ID)
+	msg := fmt.Sprintf("Your request to %s has expired as nobody reviewed it within %s. Feel free to send it again.", req.Summary(what), what.ApprovalTimeout)
+	if err := fbapi.SendRawMessage(req.From.ID, msg); err != nil {
+		glog.Warningf("failed to notify %s about expired approval request %s: %s", req.From.ID, req.ID, err.Error())
+	}
+}
+
+func (c *ChatbotHandler) remindApprovers(req ApprovalRequest, what auth.Command, now time.Time) {
+	req.RemindedAt = now
+	if err := c.Approvals.Save(req); err != nil {
+		glog.Errorf("failed to update reminder time of approval request %s: %s", req.ID, err.Error())
+		return
+	}
+	msg := fmt.Sprintf("Reminder: User '%s'(ID: %s) is still waiting for approval to %s (requested %s ago)", req.From.Name, req.From.ID, req.Summary(what), now.Sub(req.CreatedAt).Round(time.Minute))
+	c.notifyApprovers(req, what, msg)
+}
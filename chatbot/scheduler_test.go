@@ -0,0 +1,76 @@
+package chatbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// countSent returns the number of messages sent to recipient which contain text
+func countSent(f *fakeSendAPI, recipient, text string) int {
+	n := 0
+	for _, m := range f.to(recipient) {
+		if strings.Contains(m.Text, text) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestExpiredApprovalNotifiesRequesterOnce(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	const requester = "psid-waiting"
+	req := requestApproval(t, c, requester, "setup_wireguard", "laptop")
+
+	c.runScheduledTasks(req.CreatedAt.Add(23 * time.Hour))
+	if _, decided, _ := c.Approvals.Get(req.ID); decided {
+		t.Fatal("request expired before its approval timeout")
+	}
+	for _, after := range []time.Duration{24 * time.Hour, 25 * time.Hour, 48 * time.Hour} {
+		c.runScheduledTasks(req.CreatedAt.Add(after))
+	}
+
+	d, decided, _ := c.Approvals.Get(req.ID)
+	if !decided || d.State != ApprovalStateExpired || d.DecidedBy.Name != approvalTimeoutModerator.Name {
+		t.Fatalf("got decision %+v after the approval timeout", d)
+	}
+	if n := countSent(sendAPI, requester, "has expired"); n != 1 {
+		t.Fatalf("requester was notified %d times", n)
+	}
+	if pending, _ := c.Approvals.Pending(); len(pending) != 0 {
+		t.Fatalf("%d requests still pending", len(pending))
+	}
+}
+
+func TestApprovalReminders(t *testing.T) {
+	sendAPI := stubSendAPI(t)
+	c := newTestHandler(t)
+	c.mu.Lock()
+	for i, cmd := range c.rbacConfig.Commands {
+		if cmd.ID == "setup_wireguard" {
+			c.rbacConfig.Commands[i].ApprovalReminderInterval = 4 * time.Hour
+		}
+	}
+	c.mu.Unlock()
+	req := requestApproval(t, c, "psid-waiting", "setup_wireguard", "laptop")
+
+	tests := []struct {
+		after         time.Duration
+		wantReminders int
+	}{
+		{after: 3 * time.Hour, wantReminders: 0},
+		{after: 4 * time.Hour, wantReminders: 1},
+		{after: 7 * time.Hour, wantReminders: 1},
+		{after: 8 * time.Hour, wantReminders: 2},
+		// expired requests are not reminded about
+		{after: 24 * time.Hour, wantReminders: 2},
+		{after: 28 * time.Hour, wantReminders: 2},
+	}
+	for _, tt := range tests {
+		c.runScheduledTasks(req.CreatedAt.Add(tt.after))
+		if n := countSent(sendAPI, testAdminID, "Reminder:"); n != tt.wantReminders {
+			t.Fatalf("after %s: approver got %d reminders, want %d", tt.after, n, tt.wantReminders)
+		}
+	}
+}
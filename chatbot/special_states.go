@@ -0,0 +1,97 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+)
+
+const recentJobsLimit = 10
+
+// specialStateHandlers generate the content shown to a user when they enter a state with the given special state type
+var specialStateHandlers = map[statemachine.SpecialStateType]func(c *ChatbotHandler, user auth.User) (string, error){
+	statemachine.JobsStateType:        listJobs,
+	statemachine.GrantsStateType:      listGrants,
+	statemachine.RequestRoleStateType: listRequestableRoles,
+	statemachine.LinkAccountStateType: showLinkedAccount,
+}
+
+// specialStateInputHandlers process user input in states with the given special state type
+var specialStateInputHandlers = map[statemachine.SpecialStateType]func(c *ChatbotHandler, user auth.User, input string) (string, error){
+	statemachine.JobOutputStateType:   showJobOutput,
+	statemachine.GrantsStateType:      manageGrants,
+	statemachine.RequestRoleStateType: requestRole,
+	statemachine.LinkAccountStateType: unlinkAccount,
+}
+
+// enterSpecialState appends the generated content of special states to the state message
+func (c *ChatbotHandler) enterSpecialState(user auth.User, state statemachine.State, moveFSMResult *MoveFSMResult) {
+	handler, ok := specialStateHandlers[state.SpecialStateType]
+	if !ok {
+		return
+	}
+	content, err := handler(c, user)
+	if err != nil {
+		moveFSMResult.AdditionalMsg = fmt.Sprintf("Something went wrong: %s", err.Error())
+		return
+	}
+	moveFSMResult.CmdOutput = fmt.Sprintf("%s\n\n%s", state.Message, content)
+}
+
+func listJobs(c *ChatbotHandler, user auth.User) (string, error) {
+	userJobs, err := c.Jobs.ForUser(user.ID, recentJobsLimit)
+	if err != nil {
+		return "", err
+	}
+	if len(userJobs) == 0 {
+		return "You have not run any commands yet.", nil
+	}
+	lines := []string{}
+	for _, j := range userJobs {
+		lines = append(lines, formatJob(j))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func formatJob(j jobs.Job) string {
+	res := fmt.Sprintf("- %s: '%s' with input '%s' - %s, queued %s", j.ID, j.CmdName, j.Input, j.Status, j.QueuedAt.Format(time.RFC1123))
+	if j.Finished() && !j.StartedAt.IsZero() {
+		res += fmt.Sprintf(", took %s", j.EndedAt.Sub(j.StartedAt).Round(time.Second))
+	}
+	if j.Approver != nil {
+		res += fmt.Sprintf(", approved by %s", j.Approver.Name)
+	}
+	return res
+}
+
+// adminRole is the role whose members can see the output of every job
+var adminRole = auth.Role{Name: "admin"}
+
+// showJobOutput returns the output of the job with id input.
+// Only the requester and admins may see it.
+func showJobOutput(c *ChatbotHandler, user auth.User, input string) (string, error) {
+	id := strings.TrimSpace(input)
+	j, found, err := c.Jobs.Get(id)
+	if err != nil {
+		glog.Errorf("failed to get job %s: %s", id, err.Error())
+		return "", fmt.Errorf("Failed to read job '%s'", id)
+	}
+	allowed := found && (j.Requester.ID == user.ID || c.RBAC().UserHasRole(user, adminRole))
+	if !allowed {
+		// do not tell apart jobs that do not exist from jobs of other users
+		glog.Warningf("user %s requested output of job '%s' which does not exist or they are not allowed to see", user.ID, id)
+		return "", fmt.Errorf("Could not find job '%s' among your jobs", id)
+	}
+	if j.OutputPruned {
+		return "", fmt.Errorf("The output of job %s has been deleted as it is older than the retention period", j.ID)
+	}
+	if !j.Finished() {
+		return fmt.Sprintf("Job %s is still %s", j.ID, j.Status), nil
+	}
+	return fmt.Sprintf("%s\n\nOutput:\n%s", formatJob(j), j.Output), nil
+}
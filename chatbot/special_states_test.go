@@ -0,0 +1,61 @@
+package chatbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
+)
+
+func TestShowJobOutputAccess(t *testing.T) {
+	stubSendAPI(t)
+	c := newTestHandler(t)
+	const requester, friend, stranger = "psid-owner", "psid-friend", "psid-stranger"
+	// friends approve the command but are not admins
+	c.mu.Lock()
+	for i, cmd := range c.rbacConfig.Commands {
+		if cmd.ID == "setup_wireguard" {
+			c.rbacConfig.Commands[i].ApprovedBy = auth.Role{Name: "friend"}
+		}
+	}
+	c.mu.Unlock()
+	if err := c.Grants.Save(auth.Grant{ID: "friend", UserID: friend, Role: "friend", GrantedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan jobs.Job, 1)
+	j, err := c.Jobs.Submit(auth.Command{ID: "setup_wireguard", CMD: "echo private-output"}, "laptop", nil, c.RBAC().WhoAmI(requester), nil, nil, func(j jobs.Job, output string, err error) {
+		done <- j
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job did not finish")
+	}
+
+	tests := []struct {
+		name      string
+		userID    string
+		wantShown bool
+	}{
+		{name: "requester", userID: requester, wantShown: true},
+		{name: "admin", userID: testAdminID, wantShown: true},
+		{name: "approver of the command", userID: friend},
+		{name: "other user", userID: stranger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := showJobOutput(c, c.RBAC().WhoAmI(tt.userID), j.ID)
+			if shown := err == nil && strings.Contains(out, "private-output"); shown != tt.wantShown {
+				t.Fatalf("got %q %v, want shown %t", out, err, tt.wantShown)
+			}
+		})
+	}
+	if _, err := showJobOutput(c, c.RBAC().WhoAmI(requester), "missing"); err == nil || !strings.Contains(err.Error(), "among your jobs") {
+		t.Fatalf("got %v for a job which does not exist", err)
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// InitialState is the state every conversation starts in
+const InitialState = "Initial"
+
 type FSMWithStatesAndEvents struct {
 	FSM       *fsm.FSM
 	EventDesc []fsm.EventDesc `yaml:"statemachine"`
@@ -44,11 +47,24 @@ func ChatBotFSM(configFile string) (*FSMWithStatesAndEvents, error) {
 	if !foundRBACSpec || err != nil {
 		return nil, errors.Errorf("did not find valid FSM config in file %s. Err: %s", configFile, err.Error())
 	}
-	f.FSM = fsm.NewFSM("Initial", f.EventDesc, map[string]fsm.Callback{})
+	if err := checkInputs(f.States); err != nil {
+		return nil, errors.Wrapf(err, "invalid inputs in config file %s", configFile)
+	}
+	f.FSM = fsm.NewFSM(InitialState, f.EventDesc, map[string]fsm.Callback{})
 	glog.Infof("successfully parsed config file into fsm %+v", f)
 	return &f, nil
 }
 
+// Clone returns a new FSM in the initial state which shares states and events with f
+func (f FSMWithStatesAndEvents) Clone() *FSMWithStatesAndEvents {
+	return &FSMWithStatesAndEvents{
+		FSM:       fsm.NewFSM(InitialState, f.EventDesc, map[string]fsm.Callback{}),
+		EventDesc: f.EventDesc,
+		States:    f.States,
+		Events:    f.Events,
+	}
+}
+
 func (f FSMWithStatesAndEvents) Current() State {
 	res := State{Name: "Unknown", Message: "Hmm confused..."}
 	for _, s := range f.States {
@@ -77,3 +93,46 @@ func (f FSMWithStatesAndEvents) AvailableTransitions() []Event {
 	}
 	return res
 }
+
+// HasState returns true if a state with the given name is defined
+func (f FSMWithStatesAndEvents) HasState(name string) bool {
+	for _, s := range f.States {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasEvent returns true if name is an event of the config, whether or not it is available in the current state
+func (f FSMWithStatesAndEvents) HasEvent(name string) bool {
+	for _, e := range f.EventDesc {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInputs makes sure states with inputs have something to pass them to and that field definitions are valid
+func checkInputs(states []State) error {
+	for _, s := range states {
+		if len(s.Inputs) == 0 {
+			continue
+		}
+		if s.DefaultHandler.ID == "" {
+			return errors.Errorf("state '%s' declares inputs but has no defaultHandler", s.Name)
+		}
+		seen := map[string]bool{}
+		for _, field := range s.Inputs {
+			if err := field.Check(); err != nil {
+				return errors.Wrapf(err, "state '%s'", s.Name)
+			}
+			if seen[field.Name] {
+				return errors.Errorf("state '%s' declares input '%s' more than once", s.Name, field.Name)
+			}
+			seen[field.Name] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package statemachine
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+/* The conversation state machine rendered as a diagram. States are annotated with their permissions,
+default handler and inputs. Edges into states with permissions are colored by the role granting them. */
+
+// Colors of edges into states with permissions, assigned to roles in name order
+var roleColors = []string{"#d62728", "#1f77b4", "#2ca02c", "#9467bd", "#ff7f0e", "#8c564b", "#e377c2", "#17becf"}
+
+// Edges into states with permissions no role grants
+const noRoleColor = "#7f7f7f"
+
+var mermaidIDRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type graphEdge struct {
+	src, dst string
+	label    string
+	// roles granting the permissions of dst. Empty if dst needs no permissions
+	roles []string
+	color string
+}
+
+// DOT renders the state machine in Graphviz format
+func (f FSMWithStatesAndEvents) DOT(rbac auth.RBACConfig) string {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "digraph chatbot {")
+	fmt.Fprintln(b, `  node [shape=box, style=rounded, fontname="Helvetica"];`)
+	fmt.Fprintln(b, `  edge [fontname="Helvetica", fontsize=10];`)
+	for _, s := range f.States {
+		attrs := ""
+		if s.DefaultHandler.ID != "" || s.SpecialStateType != "" {
+			attrs = `, style="rounded,filled", fillcolor="#fff2cc"`
+		}
+		if len(s.Permissions) > 0 {
+			attrs += `, penwidth=2`
+		}
+		fmt.Fprintf(b, "  %s [label=%s%s];\n", dotQuote(s.Name), dotQuote(strings.Join(stateLabel(s), "\n")), attrs)
+	}
+	for _, e := range f.edges(rbac) {
+		attrs := ""
+		if e.color != "" {
+			attrs = fmt.Sprintf(", color=%s, fontcolor=%s", dotQuote(e.color), dotQuote(e.color))
+		}
+		fmt.Fprintf(b, "  %s -> %s [label=%s%s];\n", dotQuote(e.src), dotQuote(e.dst), dotQuote(e.label), attrs)
+	}
+	fmt.Fprintln(b, "}")
+	return b.String()
+}
+
+// Mermaid renders the state machine as a Mermaid flowchart
+func (f FSMWithStatesAndEvents) Mermaid(rbac auth.RBACConfig) string {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "flowchart TD")
+	for _, s := range f.States {
+		fmt.Fprintf(b, "  %s[\"%s\"]\n", mermaidID(s.Name), mermaidEscape(strings.Join(stateLabel(s), "<br/>")))
+		if s.DefaultHandler.ID != "" || s.SpecialStateType != "" {
+			fmt.Fprintf(b, "  style %s fill:#fff2cc\n", mermaidID(s.Name))
+		}
+	}
+	styles := []string{}
+	for i, e := range f.edges(rbac) {
+		fmt.Fprintf(b, "  %s -->|\"%s\"| %s\n", mermaidID(e.src), mermaidEscape(e.label), mermaidID(e.dst))
+		if e.color != "" {
+			styles = append(styles, fmt.Sprintf("  linkStyle %d stroke:%s,color:%s", i, e.color, e.color))
+		}
+	}
+	for _, s := range styles {
+		fmt.Fprintln(b, s)
+	}
+	return b.String()
+}
+
+// edges returns one edge per transition source in config order
+func (f FSMWithStatesAndEvents) edges(rbac auth.RBACConfig) []graphEdge {
+	messages := map[string]string{}
+	for _, e := range f.Events {
+		messages[e.Name] = e.Message
+	}
+	states := map[string]State{}
+	for _, s := range f.States {
+		states[s.Name] = s
+	}
+	colors := roleColorMap(rbac.Roles)
+
+	res := []graphEdge{}
+	for _, desc := range f.EventDesc {
+		label := desc.Name
+		if m := messages[desc.Name]; m != "" && m != desc.Name {
+			label = fmt.Sprintf("%s (%s)", m, desc.Name)
+		}
+		e := graphEdge{dst: desc.Dst}
+		if perms := states[desc.Dst].Permissions; len(perms) > 0 {
+			e.roles = rolesGranting(rbac, perms)
+			e.color = noRoleColor
+			if len(e.roles) > 0 {
+				e.color = colors[e.roles[0]]
+			}
+			if len(e.roles) > 0 {
+				label += " [" + strings.Join(e.roles, ", ") + "]"
+			} else {
+				label += " [no role]"
+			}
+		}
+		e.label = label
+		for _, src := range desc.Src {
+			e.src = src
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// stateLabel returns the name of s followed by its annotations
+func stateLabel(s State) []string {
+	lines := []string{s.Name}
+	if len(s.Permissions) > 0 {
+		perms := []string{}
+		for _, p := range s.Permissions {
+			perms = append(perms, p.ID())
+		}
+		lines = append(lines, "permissions: "+strings.Join(perms, ", "))
+	}
+	if s.DefaultHandler.ID != "" {
+		handler := "runs: " + s.DefaultHandler.PrettyName
+		if s.DefaultHandler.ApprovedBy.Name != "" {
+			handler += fmt.Sprintf(" (approved by %s)", s.DefaultHandler.ApprovedBy.Name)
+		}
+		lines = append(lines, handler)
+	}
+	if len(s.Inputs) > 0 {
+		names := []string{}
+		for _, in := range s.Inputs {
+			names = append(names, in.Name)
+		}
+		lines = append(lines, "inputs: "+strings.Join(names, ", "))
+	}
+	if s.SpecialStateType != "" {
+		lines = append(lines, fmt.Sprintf("special: %s", s.SpecialStateType))
+	}
+	return lines
+}
+
+// rolesGranting returns the names of the roles which have all of perms, including inherited and pattern permissions, sorted
+func rolesGranting(rbac auth.RBACConfig, perms []gorbac.StdPermission) []string {
+	res := []string{}
+	for _, r := range rbac.Roles {
+		all := true
+		for _, p := range perms {
+			all = all && rbac.RoleIsAllowed(r.Name, p)
+		}
+		if all {
+			res = append(res, r.Name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func roleColorMap(roles []auth.Role) map[string]string {
+	names := []string{}
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	res := map[string]string{}
+	for i, n := range names {
+		res[n] = roleColors[i%len(roleColors)]
+	}
+	return res
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+func mermaidID(name string) string {
+	return "s_" + mermaidIDRe.ReplaceAllString(name, "_")
+}
+
+func mermaidEscape(s string) string {
+	return strings.Replace(s, `"`, "#quot;", -1)
+}
@@ -0,0 +1,40 @@
+package statemachine
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+)
+
+const shippedConfig = "../config/viktorwebservices.yaml"
+
+// The committed diagrams are the golden output for the shipped config
+func TestGraphMatchesCommittedDiagrams(t *testing.T) {
+	f, err := ChatBotFSM(shippedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbac, err := auth.NewRBACConfig(shippedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		golden string
+		render func(auth.RBACConfig) string
+	}{
+		{golden: "../../diagrams/state-machine.dot", render: f.DOT},
+		{golden: "../../diagrams/state-machine.mmd", render: f.Mermaid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			want, err := ioutil.ReadFile(tt.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.render(rbac); got != string(want) {
+				t.Fatalf("%s is out of date, run go generate in the repository root. Got:\n%s", tt.golden, got)
+			}
+		})
+	}
+}
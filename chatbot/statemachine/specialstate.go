@@ -26,10 +26,24 @@ E.g: VPN state would like to accept any input for the public key and run some os
 type SpecialStateType string
 
 // Defined special state types. Make sure you define new ones in the map below
+// or in the chatbot's specialStateHandlers
 const (
 	VPNStateType = "vpn"
+	// Lists the user's recent jobs
+	JobsStateType = "jobs"
+	// Accepts a job id and shows the output of that job
+	JobOutputStateType = "job_output"
+	// Lists temporary roles and accepts commands granting or revoking them
+	GrantsStateType = "grants"
+	// Lists the roles the user can request and sends requests for them to the roles' approvers
+	RequestRoleStateType = "request_role"
+	// Shows the linked Authentik account with a one-time login link, accepts "unlink"
+	LinkAccountStateType = "link_account"
 )
 
+// KnownSpecialStateTypes are the values accepted for specialStateType in the config file
+var KnownSpecialStateTypes = []SpecialStateType{VPNStateType, JobsStateType, JobOutputStateType, GrantsStateType, RequestRoleStateType, LinkAccountStateType}
+
 var (
 	SpecialStateTypeCallback map[SpecialStateType]func(string) (string, error) = map[SpecialStateType]func(string) (string, error){
 		VPNStateType: VPNStateTypeHandler,
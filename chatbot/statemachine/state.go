@@ -2,6 +2,7 @@ package statemachine
 
 import (
 	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/validation"
 
 	"github.com/viktorbarzin/gorbac"
 )
@@ -14,6 +15,10 @@ type State struct {
 	Permissions    []gorbac.StdPermission `yaml:"permissions"`
 	Commands       []auth.Command         `yaml:"commands"`
 	DefaultHandler auth.Command           `yaml:"defaultHandler"`
+	// Fields collected one by one before running DefaultHandler. See validation.Field
+	Inputs []validation.Field `yaml:"inputs"`
+	// Set for states whose content is generated by code. See specialstate.go
+	SpecialStateType SpecialStateType `yaml:"specialStateType"`
 }
 
 func NewState(name, message string) State {
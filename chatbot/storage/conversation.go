@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const conversationsBucket = "conversations"
+
+// Conversation is the persisted part of a user's dialog with the chatbot
+type Conversation struct {
+	// Current FSM state of the user
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"lastSeen"`
+	// Input the user has sent which has not been acted upon yet
+	PendingInput string `json:"pendingInput,omitempty"`
+	// Answers to the inputs of the current state collected so far
+	Fields map[string]string `json:"fields,omitempty"`
+	// Follow-up question the user has been asked. Their next message answers it instead of moving the FSM
+	Prompt *Prompt `json:"prompt,omitempty"`
+}
+
+// Prompt is a follow-up question which is not part of the FSM config e.g "why did you reject this request?"
+type Prompt struct {
+	// Kind identifies the handler for the answer
+	Kind string `json:"kind"`
+	// Ref is what the question is about e.g an approval request id
+	Ref string `json:"ref"`
+}
+
+// ConversationStore keeps track of where each user is in the conversation
+type ConversationStore interface {
+	// Load returns the conversation for userID. Returns false if the user has no saved conversation.
+	Load(userID string) (Conversation, bool, error)
+	Save(userID string, c Conversation) error
+	Delete(userID string) error
+}
+
+type conversationStore struct {
+	store Store
+}
+
+// NewConversationStore returns a ConversationStore backed by s
+func NewConversationStore(s Store) ConversationStore {
+	return &conversationStore{store: s}
+}
+
+func (c *conversationStore) Load(userID string) (Conversation, bool, error) {
+	var conv Conversation
+	found, err := c.store.Get(conversationsBucket, userID, &conv)
+	if err != nil {
+		return Conversation{}, false, errors.Wrapf(err, "failed to load conversation for user %s", userID)
+	}
+	return conv, found, nil
+}
+
+func (c *conversationStore) Save(userID string, conv Conversation) error {
+	if err := c.store.Put(conversationsBucket, userID, conv); err != nil {
+		return errors.Wrapf(err, "failed to save conversation for user %s", userID)
+	}
+	return nil
+}
+
+func (c *conversationStore) Delete(userID string) error {
+	if err := c.store.Delete(conversationsBucket, userID); err != nil {
+		return errors.Wrapf(err, "failed to delete conversation for user %s", userID)
+	}
+	return nil
+}
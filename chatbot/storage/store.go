@@ -0,0 +1,160 @@
+// Package storage persists chatbot state (conversations, approvals, jobs...) across restarts
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Store is a bucketed key-value store. Values are JSON encoded.
+type Store interface {
+	// Get decodes the value stored at bucket/key into v. Returns false if the key does not exist.
+	Get(bucket, key string, v interface{}) (bool, error)
+	Put(bucket, key string, v interface{}) error
+	Delete(bucket, key string) error
+	// Keys returns the sorted keys in bucket
+	Keys(bucket string) ([]string, error)
+}
+
+// FileStore is a Store which keeps everything in memory and flushes to a single JSON file on every write.
+// The data set is small (1 record per user/request) so rewriting the whole file is fine.
+// Writes only change the in-memory state once they are on disk.
+type FileStore struct {
+	mu      sync.RWMutex
+	path    string
+	buckets map[string]map[string]json.RawMessage
+}
+
+// NewFileStore loads the store from path. If path is empty, nothing is persisted.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, buckets: map[string]map[string]json.RawMessage{}}
+	if path == "" {
+		return s, nil
+	}
+	fileBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read store file %s", path)
+	}
+	if len(fileBytes) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(fileBytes, &s.buckets); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode store file %s", path)
+	}
+	return s, nil
+}
+
+func (s *FileStore) Get(bucket, key string, v interface{}) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	raw, ok := s.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, errors.Wrapf(err, "failed to decode %s/%s", bucket, key)
+	}
+	return true, nil
+}
+
+func (s *FileStore) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s/%s", bucket, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.withBucket(bucket)
+	next[bucket][key] = raw
+	return s.swap(next)
+}
+
+func (s *FileStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	next := s.withBucket(bucket)
+	delete(next[bucket], key)
+	return s.swap(next)
+}
+
+func (s *FileStore) Keys(bucket string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []string{}
+	for k := range s.buckets[bucket] {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// withBucket returns a copy of the buckets in which bucket can be changed without affecting the current ones.
+// Other buckets are shared as they are not modified. Must be called with the write lock held.
+func (s *FileStore) withBucket(bucket string) map[string]map[string]json.RawMessage {
+	next := make(map[string]map[string]json.RawMessage, len(s.buckets)+1)
+	for name, b := range s.buckets {
+		next[name] = b
+	}
+	changed := make(map[string]json.RawMessage, len(s.buckets[bucket])+1)
+	for k, v := range s.buckets[bucket] {
+		changed[k] = v
+	}
+	next[bucket] = changed
+	return next
+}
+
+// swap persists next and makes it the current state. If persisting fails, the current state is kept
+// so that memory never holds changes the caller was told failed. Must be called with the write lock held.
+func (s *FileStore) swap(next map[string]map[string]json.RawMessage) error {
+	if err := s.flush(next); err != nil {
+		return err
+	}
+	s.buckets = next
+	return nil
+}
+
+// flush writes buckets to a temp file and renames it so a crash never leaves a half written store behind
+func (s *FileStore) flush(buckets map[string]map[string]json.RawMessage) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode store")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp file for %s", s.path)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to write %s", tmp.Name())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to sync %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to close %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to move %s to %s", tmp.Name(), s.path)
+	}
+	return nil
+}
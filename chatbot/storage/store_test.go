@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFileStorePersists(t *testing.T) {
+	path := filepath.Join(tempDir(t), "state.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "a", "c"} {
+		if err := s.Put("bucket", k, k+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("bucket", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("bucket", "missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := reopened.Keys("bucket")
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("got keys %v %v", keys, err)
+	}
+	var v string
+	if found, err := reopened.Get("bucket", "a", &v); !found || err != nil || v != "a-value" {
+		t.Fatalf("got %v %q %v", found, v, err)
+	}
+	if found, _ := reopened.Get("bucket", "c", &v); found {
+		t.Fatal("deleted key was restored")
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp*")); len(files) != 0 {
+		t.Fatalf("temp files left behind: %v", files)
+	}
+}
+
+func TestFileStoreKeepsStateWhenWriteFails(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "state.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("bucket", "kept", 1); err != nil {
+		t.Fatal(err)
+	}
+	// the temp file can no longer be created next to the store
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("bucket", "new", 2); err == nil {
+		t.Fatal("Put succeeded without a directory to write to")
+	}
+	if err := s.Delete("bucket", "kept"); err == nil {
+		t.Fatal("Delete succeeded without a directory to write to")
+	}
+	var v int
+	if found, _ := s.Get("bucket", "new", &v); found {
+		t.Fatal("failed Put changed the in-memory state")
+	}
+	if found, _ := s.Get("bucket", "kept", &v); !found || v != 1 {
+		t.Fatal("failed Delete changed the in-memory state")
+	}
+
+	// the next successful write persists only what succeeded
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("other", "k", 3); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := reopened.Keys("bucket")
+	if !reflect.DeepEqual(keys, []string{"kept"}) {
+		t.Fatalf("got keys %v after recovering", keys)
+	}
+}
+
+func TestConversationStoreRestores(t *testing.T) {
+	path := filepath.Join(tempDir(t), "state.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Conversation{
+		State:    "Info",
+		LastSeen: time.Now().UTC().Truncate(time.Second),
+		Fields:   map[string]string{"dns": "1.1.1.1"},
+		Prompt:   &Prompt{Kind: "reject-reason", Ref: "req-1"},
+	}
+	if err := NewConversationStore(s).Save("psid", want); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversations := NewConversationStore(reopened)
+	got, found, err := conversations.Load("psid")
+	if err != nil || !found || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v %v %v, want %+v", got, found, err, want)
+	}
+	if err := conversations.Delete("psid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := conversations.Load("psid"); found {
+		t.Fatal("deleted conversation was loaded")
+	}
+}
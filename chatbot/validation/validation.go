@@ -0,0 +1,202 @@
+// Package validation checks user input against the rules and typed fields declared in the config file
+package validation
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type Type string
+
+const (
+	TypeString          Type = "string"
+	TypeEmail           Type = "email"
+	TypeIP              Type = "ip"
+	TypeIPv4            Type = "ipv4"
+	TypeCIDR            Type = "cidr"
+	TypeBase64Key       Type = "base64-key"
+	TypeWireguardPubKey Type = "wireguard-pubkey"
+
+	// Longest value accepted for any field
+	maxValueLen = 500
+)
+
+// Field names become env variable names so keep them simple
+var fieldNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Rule is a set of constraints on a value. Unset constraints are not checked
+type Rule struct {
+	// Defaults to string, which accepts anything
+	Type Type `yaml:"type" json:"type"`
+	// Pattern the whole value must match
+	Regex     string `yaml:"regex" json:"regex"`
+	MinLength int    `yaml:"minLength" json:"minLength"`
+	MaxLength int    `yaml:"maxLength" json:"maxLength"`
+}
+
+// Field is a single named value the chatbot asks the user for before running a command
+type Field struct {
+	Name string `yaml:"name"`
+	Rule `yaml:",inline"`
+	// Empty values are rejected for required fields
+	Required bool `yaml:"required"`
+	// Question sent to the user. Defaults to "Please enter <name>"
+	Prompt string `yaml:"prompt"`
+}
+
+// Check returns an error if the rule itself is invalid
+func (r Rule) Check() error {
+	switch r.Type {
+	case "", TypeString, TypeEmail, TypeIP, TypeIPv4, TypeCIDR, TypeBase64Key, TypeWireguardPubKey:
+	default:
+		return fmt.Errorf("unknown type '%s'", r.Type)
+	}
+	if r.Regex != "" {
+		if _, err := r.regex(); err != nil {
+			return fmt.Errorf("invalid regex: %s", err.Error())
+		}
+	}
+	if r.MinLength < 0 || r.MaxLength < 0 {
+		return fmt.Errorf("lengths must not be negative")
+	}
+	if r.MaxLength > 0 && r.MinLength > r.MaxLength {
+		return fmt.Errorf("minLength %d is greater than maxLength %d", r.MinLength, r.MaxLength)
+	}
+	return nil
+}
+
+// Validate returns a user friendly error naming the constraint value does not satisfy
+func (r Rule) Validate(value string) error {
+	if r.MinLength > 0 && len(value) < r.MinLength {
+		return fmt.Errorf("must be at least %d characters long", r.MinLength)
+	}
+	if r.MaxLength > 0 && len(value) > r.MaxLength {
+		return fmt.Errorf("must be at most %d characters long", r.MaxLength)
+	}
+	if err := validateType(r.Type, value); err != nil {
+		return err
+	}
+	if r.Regex != "" {
+		re, err := r.regex()
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("must match '%s'", r.Regex)
+		}
+	}
+	return nil
+}
+
+// regex anchors the pattern so that it has to match the whole value
+func (r Rule) regex() (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + r.Regex + `)$`)
+}
+
+// CheckRules returns an error for the first invalid rule
+func CheckRules(rules []Rule) error {
+	for i, r := range rules {
+		if err := r.Check(); err != nil {
+			return fmt.Errorf("validator %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// ValidateRules checks value against all rules. The error says which rule failed and why
+func ValidateRules(rules []Rule, value string) error {
+	for i, r := range rules {
+		if err := r.Validate(value); err != nil {
+			return fmt.Errorf("input %s (validator %d)", err.Error(), i+1)
+		}
+	}
+	return nil
+}
+
+// Check returns an error if the field definition itself is invalid
+func (f Field) Check() error {
+	if !fieldNameRe.MatchString(f.Name) {
+		return fmt.Errorf("invalid field name '%s', must match %s", f.Name, fieldNameRe.String())
+	}
+	if err := f.Rule.Check(); err != nil {
+		return fmt.Errorf("field '%s': %s", f.Name, err.Error())
+	}
+	return nil
+}
+
+// Validate returns a user friendly error if value is not acceptable for the field.
+// Empty values are only accepted for optional fields.
+func (f Field) Validate(value string) error {
+	if value == "" {
+		if f.Required {
+			return fmt.Errorf("%s is required", f.Name)
+		}
+		return nil
+	}
+	if len(value) > maxValueLen {
+		return fmt.Errorf("%s must be at most %d characters long", f.Name, maxValueLen)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%s must be a single line without control characters", f.Name)
+		}
+	}
+	if err := f.Rule.Validate(value); err != nil {
+		return fmt.Errorf("%s %s", f.Name, err.Error())
+	}
+	return nil
+}
+
+// PromptText returns the question to ask the user for this field
+func (f Field) PromptText() string {
+	prompt := f.Prompt
+	if prompt == "" {
+		prompt = fmt.Sprintf("Please enter %s", f.Name)
+	}
+	prompt = strings.TrimSpace(prompt)
+	if !f.Required {
+		prompt += "\n(optional, send 'skip' to leave it empty)"
+	}
+	return prompt
+}
+
+func validateType(t Type, value string) error {
+	switch t {
+	case "", TypeString:
+		return nil
+	case TypeEmail:
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Address != value {
+			return fmt.Errorf("must be an email address like name@example.com")
+		}
+	case TypeIP:
+		if net.ParseIP(value) == nil {
+			return fmt.Errorf("must be an IP address like 10.0.20.1")
+		}
+	case TypeIPv4:
+		if ip := net.ParseIP(value); ip == nil || ip.To4() == nil || strings.Contains(value, ":") {
+			return fmt.Errorf("must be an IPv4 address like 10.0.20.1")
+		}
+	case TypeCIDR:
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return fmt.Errorf("must be a network in CIDR notation like 10.0.20.0/24")
+		}
+	case TypeBase64Key:
+		if key, err := base64.StdEncoding.DecodeString(value); err != nil || len(key) == 0 {
+			return fmt.Errorf("must be a base64 encoded key")
+		}
+	case TypeWireguardPubKey:
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("must be a Wireguard public key (44 characters of base64)")
+		}
+	default:
+		return fmt.Errorf("has unknown type '%s'", t)
+	}
+	return nil
+}
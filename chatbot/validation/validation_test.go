@@ -0,0 +1,130 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+// A valid Wireguard public key: 32 bytes of base64
+const testPubKey = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		value   string
+		wantErr string
+	}{
+		{name: "no constraints", rule: Rule{}, value: "anything at all"},
+		{name: "regex matches", rule: Rule{Regex: "[a-z]+"}, value: "laptop"},
+		{name: "regex is anchored at the start", rule: Rule{Regex: "[a-z]+"}, value: "-x laptop", wantErr: "must match '[a-z]+'"},
+		{name: "regex is anchored at the end", rule: Rule{Regex: "[a-z]+"}, value: "laptop; rm -rf /", wantErr: "must match"},
+		{name: "alternation is anchored as a whole", rule: Rule{Regex: "a|b"}, value: "ab", wantErr: "must match"},
+		{name: "min length", rule: Rule{MinLength: 3}, value: "ab", wantErr: "at least 3 characters"},
+		{name: "min length reached", rule: Rule{MinLength: 3}, value: "abc"},
+		{name: "max length", rule: Rule{MaxLength: 3}, value: "abcd", wantErr: "at most 3 characters"},
+		{name: "max length reached", rule: Rule{MaxLength: 3}, value: "abc"},
+		{name: "email", rule: Rule{Type: TypeEmail}, value: "me@example.com"},
+		{name: "email with a name", rule: Rule{Type: TypeEmail}, value: "Me <me@example.com>", wantErr: "email address"},
+		{name: "not an email", rule: Rule{Type: TypeEmail}, value: "me", wantErr: "email address"},
+		{name: "ipv4 as ip", rule: Rule{Type: TypeIP}, value: "10.0.20.1"},
+		{name: "ipv6 as ip", rule: Rule{Type: TypeIP}, value: "fd00::1"},
+		{name: "not an ip", rule: Rule{Type: TypeIP}, value: "10.0.20", wantErr: "IP address"},
+		{name: "ipv4", rule: Rule{Type: TypeIPv4}, value: "1.1.1.1"},
+		{name: "ipv6 as ipv4", rule: Rule{Type: TypeIPv4}, value: "::ffff:1.1.1.1", wantErr: "IPv4 address"},
+		{name: "cidr", rule: Rule{Type: TypeCIDR}, value: "10.0.20.0/24"},
+		{name: "ip as cidr", rule: Rule{Type: TypeCIDR}, value: "10.0.20.0", wantErr: "CIDR"},
+		{name: "base64 key", rule: Rule{Type: TypeBase64Key}, value: "c2VjcmV0"},
+		{name: "not base64", rule: Rule{Type: TypeBase64Key}, value: "not base64!", wantErr: "base64"},
+		{name: "wireguard key", rule: Rule{Type: TypeWireguardPubKey}, value: testPubKey},
+		{name: "short wireguard key", rule: Rule{Type: TypeWireguardPubKey}, value: "c2VjcmV0", wantErr: "Wireguard public key"},
+		{name: "unknown type", rule: Rule{Type: "phone"}, value: "123", wantErr: "unknown type"},
+		{name: "type and regex", rule: Rule{Type: TypeIPv4, Regex: `10\..*`}, value: "1.1.1.1", wantErr: "must match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate(tt.value)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want '%s'", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr string
+	}{
+		{name: "empty", rule: Rule{}},
+		{name: "all set", rule: Rule{Type: TypeCIDR, Regex: "10\\..*", MinLength: 1, MaxLength: 18}},
+		{name: "unknown type", rule: Rule{Type: "phone"}, wantErr: "unknown type 'phone'"},
+		{name: "invalid regex", rule: Rule{Regex: "[a-z"}, wantErr: "invalid regex"},
+		{name: "negative length", rule: Rule{MinLength: -1}, wantErr: "must not be negative"},
+		{name: "min above max", rule: Rule{MinLength: 5, MaxLength: 2}, wantErr: "minLength 5 is greater than maxLength 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Check()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want '%s'", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	rules := []Rule{{MinLength: 1}, {Regex: "[a-z]*"}}
+	if err := ValidateRules(rules, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateRules(rules, "Laptop"); err == nil || !strings.Contains(err.Error(), "(validator 2)") {
+		t.Fatalf("got %v, want the second validator to fail", err)
+	}
+}
+
+func TestFieldValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   Field
+		value   string
+		wantErr string
+	}{
+		{name: "required", field: Field{Name: "dns", Required: true}, value: "", wantErr: "dns is required"},
+		{name: "optional and empty", field: Field{Name: "dns", Rule: Rule{Type: TypeIP}}, value: ""},
+		{name: "rule applies", field: Field{Name: "dns", Rule: Rule{Type: TypeIP}}, value: "dns.google", wantErr: "dns must be an IP address"},
+		{name: "control characters", field: Field{Name: "name"}, value: "a\nb", wantErr: "single line"},
+		{name: "too long", field: Field{Name: "name"}, value: strings.Repeat("a", maxValueLen+1), wantErr: "at most 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.field.Validate(tt.value)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want '%s'", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFieldCheck(t *testing.T) {
+	for _, name := range []string{"dns", "forward_to", "a1"} {
+		if err := (Field{Name: name}).Check(); err != nil {
+			t.Errorf("field '%s': %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "DNS", "1a", "forward-to", "a b"} {
+		if err := (Field{Name: name}).Check(); err == nil {
+			t.Errorf("field name '%s' was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot"
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+// runExplain prints how a user gets the permissions of a command, state or single permission, or which ones they lack.
+// Exits with 1 if the user is not allowed.
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	configFile := fs.String(fsmFlagName, os.Getenv(configEnvVarName), "Chatbot config file. May also be given as the first argument.")
+	dataDir := fs.String(dataDirFlagName, os.Getenv(dataDirEnvVarName), "Directory with the chatbot state. If set, temporary grants issued from chat and linked accounts are taken into account.")
+	userID := fs.String("user", "", "PSID of the user.")
+	command := fs.String("command", "", "ID of the command to explain.")
+	state := fs.String("state", "", "ID of the state to explain.")
+	permission := fs.String("permission", "", "ID of the permission to explain.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explain --user PSID (--command ID | --state ID | --permission ID) <config file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// keep glog at its defaults (log files, errors only on stderr) so the output is just the explanation
+	flag.CommandLine.Parse(nil)
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	given := 0
+	for _, s := range []string{*command, *state, *permission} {
+		if s != "" {
+			given++
+		}
+	}
+	if *configFile == "" || *userID == "" || given != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	rbac, err := auth.NewRBACConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if *dataDir != "" {
+		store, err := storage.NewFileStore(filepath.Join(*dataDir, stateFileName))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		if rbac.Grants, err = chatbot.NewGrantStore(store).All(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		if rbac.Identities, err = chatbot.NewIdentityStore(store).All(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	}
+	user := rbac.WhoAmI(*userID)
+
+	var explanation auth.Explanation
+	switch {
+	case *command != "":
+		cmd, ok := findCommand(rbac, *command)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "there is no command '%s'\n", *command)
+			return 2
+		}
+		explanation = rbac.ExplainCommand(user, cmd)
+	case *state != "":
+		f, err := statemachine.ChatBotFSM(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		found := false
+		for _, s := range f.States {
+			if s.Name == *state {
+				found = true
+				explanation = rbac.Explain(user, fmt.Sprintf("enter state '%s'", s.Name), auth.ToPermissions(s.Permissions))
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "there is no state '%s'\n", *state)
+			return 2
+		}
+	default:
+		explanation = rbac.Explain(user, fmt.Sprintf("use permission '%s'", *permission), []gorbac.Permission{gorbac.NewStdPermission(*permission)})
+	}
+	fmt.Println(explanation.String())
+	if !explanation.Allowed {
+		if *command != "" {
+			cmd, _ := findCommand(rbac, *command)
+			fmt.Printf("Requests to run it are sent to role '%s' for approval\n", cmd.ApprovedBy.Name)
+		}
+		return 1
+	}
+	return 0
+}
+
+func findCommand(rbac auth.RBACConfig, id string) (auth.Command, bool) {
+	for _, c := range rbac.Commands {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return auth.Command{}, false
+}
@@ -3,12 +3,12 @@ module github.com/viktorbarzin/webhook-handler
 go 1.14
 
 require (
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
-	github.com/google/uuid v1.2.0 // indirect
-	github.com/looplab/fsm v0.2.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/google/uuid v1.2.0
+	github.com/looplab/fsm v0.2.0
+	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.6.1 // indirect
-	github.com/viktorbarzin/gorbac v0.0.0-20210313125556-e67604920c0b // indirect
+	github.com/viktorbarzin/gorbac v0.0.0-20210313125556-e67604920c0b
 	gopkg.in/go-playground/webhooks.v5 v5.14.0
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
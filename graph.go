@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+)
+
+//go:generate go run . graph --format mermaid -o diagrams/state-machine.mmd chatbot/config/viktorwebservices.yaml
+//go:generate go run . graph --format dot -o diagrams/state-machine.dot chatbot/config/viktorwebservices.yaml
+
+// runGraph renders the conversation state machine of a config file as a Graphviz or Mermaid diagram
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	configFile := fs.String(fsmFlagName, os.Getenv(configEnvVarName), "Chatbot config file to render. May also be given as the first argument.")
+	format := fs.String("format", "dot", "Output format: dot or mermaid.")
+	output := fs.String("o", "", "File to write the diagram to. Defaults to stdout.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s graph [--format dot|mermaid] [-o file] <config file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// keep glog at its defaults (log files, errors only on stderr) so the output is just the diagram
+	flag.CommandLine.Parse(nil)
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	if *configFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := statemachine.ChatBotFSM(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	rbac, err := auth.NewRBACConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	var diagram string
+	switch *format {
+	case "dot":
+		diagram = f.DOT(rbac)
+	case "mermaid":
+		diagram = f.Mermaid(rbac)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format '%s', use dot or mermaid\n", *format)
+		return 2
+	}
+	if *output == "" {
+		fmt.Print(diagram)
+		return 0
+	}
+	if err := ioutil.WriteFile(*output, []byte(diagram), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
@@ -4,24 +4,79 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/viktorbarzin/webhook-handler/chatbot"
 	"github.com/viktorbarzin/webhook-handler/chatbot/fbapi"
+	"github.com/viktorbarzin/webhook-handler/chatbot/jobs"
+	"github.com/viktorbarzin/webhook-handler/chatbot/oidc"
+	"github.com/viktorbarzin/webhook-handler/chatbot/storage"
 
 	"github.com/golang/glog"
 )
 
 const (
-	fsmFlagName      = "fsm"
-	listenAddr       = ":3000"
-	configEnvVarName = "CONFIG"
+	fsmFlagName       = "fsm"
+	dataDirFlagName   = "data-dir"
+	listenAddr        = ":3000"
+	configEnvVarName  = "CONFIG"
+	dataDirEnvVarName = "DATA_DIR"
+	stateFileName     = "chatbot-state.json"
+
+	jobWorkersFlagName   = "job-workers"
+	jobWorkersEnvVarName = "JOB_WORKERS"
+	defaultJobWorkers    = 2
+
+	jobRetentionFlagName       = "job-output-retention"
+	jobRetentionEnvVarName     = "JOB_OUTPUT_RETENTION"
+	defaultJobRetention        = 7 * 24 * time.Hour
+	jobEncryptionKeyEnvVarName = "JOB_OUTPUT_ENCRYPTION_KEY"
+
+	configReloadIntervalFlagName   = "config-reload-interval"
+	configReloadIntervalEnvVarName = "CONFIG_RELOAD_INTERVAL"
+	defaultConfigReloadInterval    = 30 * time.Second
+
+	publicURLFlagName   = "public-url"
+	publicURLEnvVarName = "CHATBOT_PUBLIC_URL"
+
+	oidcIssuerFlagName         = "oidc-issuer"
+	oidcIssuerEnvVarName       = "OIDC_ISSUER_URL"
+	oidcClientIDEnvVarName     = "OIDC_CLIENT_ID"
+	oidcClientSecretEnvVarName = "OIDC_CLIENT_SECRET"
+	oidcGroupsClaimEnvVarName  = "OIDC_GROUPS_CLAIM"
+
+	linkMaxAgeFlagName   = "link-max-age"
+	linkMaxAgeEnvVarName = "ACCOUNT_LINK_MAX_AGE"
+	defaultLinkMaxAge    = 7 * 24 * time.Hour
 )
 
+// subcommands are run instead of the server when given as the first argument. They return the exit code
+var subcommands = map[string]func(args []string) int{
+	"validate": runValidate,
+	"graph":    runGraph,
+	"explain":  runExplain,
+	"matrix":   runMatrix,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
 	flag.Set("logtostderr", "true")
 	flag.Set("stderrthreshold", "WARNING")
 	flag.Set("v", "2")
 	fsmConfigFile := flag.String(fsmFlagName, "", "YAML file which contains the description of conversation state machine.")
+	dataDir := flag.String(dataDirFlagName, os.Getenv(dataDirEnvVarName), "Directory where chatbot state (conversations etc.) is persisted. If empty, state is kept in memory only.")
+	jobWorkers := flag.Int(jobWorkersFlagName, envInt(jobWorkersEnvVarName, defaultJobWorkers), "Max number of chatbot commands executing at the same time.")
+	jobRetention := flag.Duration(jobRetentionFlagName, envDuration(jobRetentionEnvVarName, defaultJobRetention), "How long outputs of chatbot jobs are kept. 0 keeps them forever.")
+	configReloadInterval := flag.Duration(configReloadIntervalFlagName, envDuration(configReloadIntervalEnvVarName, defaultConfigReloadInterval), "How often to check the config file for changes. 0 disables reloading on change, SIGHUP still works.")
+	publicURL := flag.String(publicURLFlagName, os.Getenv(publicURLEnvVarName), "URL this server is reachable at from browsers e.g https://webhook.example.com. Required for account linking.")
+	oidcIssuer := flag.String(oidcIssuerFlagName, os.Getenv(oidcIssuerEnvVarName), "OIDC issuer (Authentik application) users link their Messenger account to. If empty, account linking is disabled.")
+	linkMaxAge := flag.Duration(linkMaxAgeFlagName, envDuration(linkMaxAgeEnvVarName, defaultLinkMaxAge), "How long a linked Authentik account gives its groups' permissions before the user has to link it again.")
 	flag.Parse()
 
 	// TEST
@@ -43,15 +98,49 @@ func main() {
 		}
 	}
 
+	stateFile := ""
+	if *dataDir != "" {
+		stateFile = filepath.Join(*dataDir, stateFileName)
+	} else {
+		glog.Warningf("--%s (or %s env variable) not set, chatbot state will be lost on restart", dataDirFlagName, dataDirEnvVarName)
+	}
+	store, err := storage.NewFileStore(stateFile)
+	if err != nil {
+		glog.Fatalf("Failed to open chatbot state store: %s", err.Error())
+	}
+
 	glog.Infof("Initializing chatbot handler with %s config file", *fsmConfigFile)
-	chatbotHandler, err := chatbot.NewChatbotHandler(*fsmConfigFile)
+	chatbotHandler, err := chatbot.NewChatbotHandler(*fsmConfigFile, store, jobs.Config{
+		Workers:         *jobWorkers,
+		EncryptionKey:   []byte(os.Getenv(jobEncryptionKeyEnvVarName)),
+		OutputRetention: *jobRetention,
+	})
 	if err != nil {
 		glog.Fatalf("Failed to create chatbot handler: %s", err.Error())
 	}
+	if *oidcIssuer != "" {
+		err := chatbotHandler.EnableAccountLinking(*publicURL, oidc.Config{
+			IssuerURL:    *oidcIssuer,
+			ClientID:     os.Getenv(oidcClientIDEnvVarName),
+			ClientSecret: os.Getenv(oidcClientSecretEnvVarName),
+			GroupsClaim:  os.Getenv(oidcGroupsClaimEnvVarName),
+		}, *linkMaxAge)
+		if err != nil {
+			glog.Fatalf("Failed to enable account linking: %s", err.Error())
+		}
+	}
+	chatbotHandler.StartScheduler()
+	reloadOnSIGHUP(chatbotHandler)
+	if *configReloadInterval > 0 {
+		chatbotHandler.WatchConfig(*configReloadInterval)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc(dockerhubPath, dockerHubHandler)
 	mux.HandleFunc(fbapi.HandlerPath, chatbotHandler.HandleFunc)
+	mux.HandleFunc(chatbotReloadPath, chatbotReloadHandler(chatbotHandler))
+	mux.HandleFunc(chatbot.LinkPath, chatbotHandler.LinkHandleFunc)
+	mux.HandleFunc(chatbot.LinkCallbackPath, chatbotHandler.LinkCallbackHandleFunc)
 	mux.HandleFunc(messageViktorHandler, MessageViktorHandleFunc)
 	mux.HandleFunc(authentikProvisionPath, authentikProvisionHandler)
 
@@ -61,3 +150,21 @@ func main() {
 		glog.Fatalf("Error: %s", err.Error())
 	}
 }
+
+// envInt returns the integer value of env variable name or def if it is not set or invalid
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envDuration returns the duration in env variable name or def if it is not set or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
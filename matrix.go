@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+// Cells of the access matrix
+const (
+	// Through the user's own roles
+	accessDirect = "direct"
+	// Through one of the user's groups
+	accessGroup = "group"
+	// The user can request the command and the approvedBy role decides
+	accessApproval = "approval"
+	accessDenied   = "denied"
+	// Nothing is required
+	accessOpen = "open"
+)
+
+// runMatrix prints every user against every permission used by a state and every command
+func runMatrix(args []string) int {
+	fs := flag.NewFlagSet("matrix", flag.ExitOnError)
+	configFile := fs.String(fsmFlagName, os.Getenv(configEnvVarName), "Chatbot config file. May also be given as the first argument.")
+	format := fs.String("format", "markdown", "Output format: markdown or csv.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s matrix [--format markdown|csv] <config file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// keep glog at its defaults (log files, errors only on stderr) so the output is just the matrix
+	flag.CommandLine.Parse(nil)
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	if *configFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	rbac, err := auth.NewRBACConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	f, err := statemachine.ChatBotFSM(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if *format != "markdown" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "unknown format '%s', use markdown or csv\n", *format)
+		return 2
+	}
+	header, rows := accessMatrix(rbac, f.States)
+	if err := writeMatrix(os.Stdout, *format, header, rows); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// writeMatrix writes the access matrix to w as a markdown table with a legend or as csv
+func writeMatrix(w io.Writer, format string, header []string, rows [][]string) error {
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+	writeMarkdownTable(w, header, rows)
+	_, err := fmt.Fprintf(w, "\n`%s`: through the user's roles, `%s`: through one of their groups, `%s`: runs after the approvedBy role approves, `%s`: nothing is required\n", accessDirect, accessGroup, accessApproval, accessOpen)
+	return err
+}
+
+// accessMatrix returns one row per user with a column per permission used by states followed by a column per command
+func accessMatrix(rbac auth.RBACConfig, states []statemachine.State) ([]string, [][]string) {
+	permissions := []string{}
+	seen := map[string]bool{}
+	for _, s := range states {
+		for _, p := range s.Permissions {
+			if !seen[p.ID()] {
+				seen[p.ID()] = true
+				permissions = append(permissions, p.ID())
+			}
+		}
+	}
+	sort.Strings(permissions)
+
+	header := []string{"user"}
+	for _, p := range permissions {
+		header = append(header, "permission "+p)
+	}
+	for _, cmd := range rbac.Commands {
+		header = append(header, "command "+cmd.ID)
+	}
+	rows := [][]string{}
+	for _, u := range rbac.Users {
+		row := []string{fmt.Sprintf("%s (%s)", u.Name, u.ID)}
+		for _, p := range permissions {
+			row = append(row, accessLevel(rbac.Explain(u, "", []gorbac.Permission{gorbac.NewStdPermission(p)})))
+		}
+		for _, cmd := range rbac.Commands {
+			level := accessLevel(rbac.ExplainCommand(u, cmd))
+			if level == accessDenied && cmd.ApprovedBy.Name != "" {
+				level = accessApproval
+			}
+			row = append(row, level)
+		}
+		rows = append(rows, row)
+	}
+	return header, rows
+}
+
+func accessLevel(e auth.Explanation) string {
+	switch {
+	case !e.Allowed:
+		return accessDenied
+	case len(e.Permissions) == 0:
+		return accessOpen
+	}
+	for _, p := range e.Permissions {
+		if p.Group != "" {
+			return accessGroup
+		}
+	}
+	return accessDirect
+}
+
+func writeMarkdownTable(w io.Writer, header []string, rows [][]string) {
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(header)))
+	for _, r := range rows {
+		fmt.Fprintf(w, "| %s |\n", strings.Join(r, " | "))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/auth"
+	"github.com/viktorbarzin/webhook-handler/chatbot/statemachine"
+
+	"github.com/viktorbarzin/gorbac"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const shippedConfig = "chatbot/config/viktorwebservices.yaml"
+
+func TestMatrixShippedConfig(t *testing.T) {
+	rbac, err := auth.NewRBACConfig(shippedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := statemachine.ChatBotFSM(shippedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rows := accessMatrix(rbac, f.States)
+	for _, format := range []string{"markdown", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			var got bytes.Buffer
+			if err := writeMatrix(&got, format, header, rows); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "matrix-"+format+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != string(want) {
+				t.Fatalf("got\n%s\nwant\n%s\nrun go test -update if the change is intended", got.String(), want)
+			}
+		})
+	}
+}
+
+func TestMatrixCells(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	config := `
+permissions:
+- idstr: "run"
+roles:
+- &admin
+  id: "admin"
+  permissions:
+  - idstr: "run"
+commands:
+- id: "restricted"
+  cmd: "true"
+  permissions:
+  - idstr: "run"
+  approvedBy: *admin
+- id: "unapproved"
+  cmd: "true"
+  permissions:
+  - idstr: "run"
+- id: "open"
+  cmd: "true"
+groups:
+- &ops
+  name: "ops"
+  roles: [*admin]
+users:
+- id: "1"
+  name: "direct"
+  roles: [*admin]
+- id: "2"
+  name: "grouped"
+  groups: [*ops]
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rbac, err := auth.NewRBACConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := []statemachine.State{{Name: "Initial", Permissions: []gorbac.StdPermission{{IDStr: "run"}}}}
+	header, rows := accessMatrix(rbac, states)
+	want := [][]string{
+		{"user", "permission run", "command restricted", "command unapproved", "command open"},
+		{"direct (1)", accessDirect, accessDirect, accessDirect, accessOpen},
+		{"grouped (2)", accessGroup, accessGroup, accessGroup, accessOpen},
+		{"Guest (__guest)", accessDenied, accessApproval, accessDenied, accessOpen},
+	}
+	if got := append([][]string{header}, rows...); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot"
+
+	"github.com/golang/glog"
+)
+
+const (
+	chatbotReloadPath = "/chatbot/reload"
+
+	chatbotAdminTokenEnvVar = "CHATBOT_ADMIN_TOKEN"
+)
+
+var chatbotAdminToken = os.Getenv(chatbotAdminTokenEnvVar)
+
+// reloadOnSIGHUP reloads the chatbot config every time the process receives SIGHUP
+func reloadOnSIGHUP(h *chatbot.ChatbotHandler) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			glog.Infof("received SIGHUP, reloading chatbot config")
+			if err := h.Reload(); err != nil {
+				glog.Errorf("failed to reload chatbot config: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// chatbotReloadHandler reloads the chatbot config. Requests must carry "Authorization: Bearer <CHATBOT_ADMIN_TOKEN>"
+func chatbotReloadHandler(h *chatbot.ChatbotHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "POST only")
+			return
+		}
+		// Reject requests when no token is configured (fail-closed)
+		if chatbotAdminToken == "" {
+			writeError(w, http.StatusInternalServerError, "admin token not configured")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(token), []byte(chatbotAdminToken)) {
+			glog.Warningf("invalid chatbot admin token from %s", r.RemoteAddr)
+			writeError(w, http.StatusForbidden, "invalid token")
+			return
+		}
+		if err := h.Reload(); err != nil {
+			glog.Errorf("failed to reload chatbot config: %s", err.Error())
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("reloaded"))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/viktorbarzin/webhook-handler/chatbot/configcheck"
+)
+
+// runValidate checks a chatbot config file and prints the problems as file:line:column: severity: message.
+// Exits with 1 if there are errors.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String(fsmFlagName, os.Getenv(configEnvVarName), "Chatbot config file to validate. May also be given as the first argument.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate <config file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// keep glog at its defaults (log files, errors only on stderr) so the output is just the problems
+	flag.CommandLine.Parse(nil)
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	if *configFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	problems, err := configcheck.Check(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	errorCount := 0
+	for _, p := range problems {
+		fmt.Printf("%s:%s\n", *configFile, p.String())
+		if p.Severity == configcheck.SeverityError {
+			errorCount++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings\n", errorCount, len(problems)-errorCount)
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
+}